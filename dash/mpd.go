@@ -0,0 +1,187 @@
+// Package dash reads MPEG-DASH manifests (ISO/IEC 23009-1) into the same parse.Result
+// as HLS playlists, so that dl.Downloader fetches and merges them the same way.
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MPD is the subset of a Media Presentation Description needed to list the segments
+type MPD struct {
+	XMLName                   xml.Name  `xml:"MPD"`
+	Type                      string    `xml:"type,attr"` // static or dynamic
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   []string  `xml:"BaseURL"`
+	Periods                   []*Period `xml:"Period"`
+}
+
+type Period struct {
+	ID              string           `xml:"id,attr"`
+	Start           string           `xml:"start,attr"`
+	Duration        string           `xml:"duration,attr"`
+	BaseURL         []string         `xml:"BaseURL"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+	AdaptationSets  []*AdaptationSet `xml:"AdaptationSet"`
+}
+
+type AdaptationSet struct {
+	ID              string            `xml:"id,attr"`
+	ContentType     string            `xml:"contentType,attr"`
+	MimeType        string            `xml:"mimeType,attr"`
+	Codecs          string            `xml:"codecs,attr"`
+	Lang            string            `xml:"lang,attr"`
+	BaseURL         []string          `xml:"BaseURL"`
+	SegmentBase     *SegmentBase      `xml:"SegmentBase"`
+	SegmentList     *SegmentList      `xml:"SegmentList"`
+	SegmentTemplate *SegmentTemplate  `xml:"SegmentTemplate"`
+	Representations []*Representation `xml:"Representation"`
+}
+
+type Representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       uint32           `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr"`
+	Height          int              `xml:"height,attr"`
+	FrameRate       string           `xml:"frameRate,attr"` // e.g. 25 or 30000/1001
+	MimeType        string           `xml:"mimeType,attr"`
+	Codecs          string           `xml:"codecs,attr"`
+	BaseURL         []string         `xml:"BaseURL"`
+	SegmentBase     *SegmentBase     `xml:"SegmentBase"`
+	SegmentList     *SegmentList     `xml:"SegmentList"`
+	SegmentTemplate *SegmentTemplate `xml:"SegmentTemplate"`
+}
+
+// URL is an Initialization or RepresentationIndex element
+type URL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"` // first-last byte, inclusive
+}
+
+// SegmentBase describes a single-file representation, its segments are listed by the 'sidx' box in IndexRange
+type SegmentBase struct {
+	Timescale      *uint64 `xml:"timescale,attr"`
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *URL    `xml:"Initialization"`
+}
+
+type SegmentList struct {
+	Timescale       *uint64          `xml:"timescale,attr"`
+	Duration        *uint64          `xml:"duration,attr"`
+	Initialization  *URL             `xml:"Initialization"`
+	SegmentTimeline *SegmentTimeline `xml:"SegmentTimeline"`
+	SegmentURLs     []*SegmentURL    `xml:"SegmentURL"`
+}
+
+type SegmentURL struct {
+	Media      string `xml:"media,attr"`
+	MediaRange string `xml:"mediaRange,attr"`
+}
+
+// SegmentTemplate builds the segment URLs from $RepresentationID$, $Number$, $Time$ and $Bandwidth$
+type SegmentTemplate struct {
+	Timescale              *uint64          `xml:"timescale,attr"`
+	Duration               *uint64          `xml:"duration,attr"`
+	StartNumber            *uint64          `xml:"startNumber,attr"`
+	PresentationTimeOffset *uint64          `xml:"presentationTimeOffset,attr"`
+	Media                  string           `xml:"media,attr"`
+	Initialization         string           `xml:"initialization,attr"`
+	SegmentTimeline        *SegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type SegmentTimeline struct {
+	S []*S `xml:"S"`
+}
+
+// S is a run of segments of the same duration: r+1 segments of d starting at t, r=-1 repeats until the next S
+type S struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int64   `xml:"r,attr"`
+}
+
+// Parse reads an MPD document
+func Parse(reader io.Reader) (*MPD, error) {
+	mpd := new(MPD)
+	if err := xml.NewDecoder(reader).Decode(mpd); err != nil {
+		return nil, fmt.Errorf("invalid MPD: %s", err.Error())
+	}
+	if len(mpd.Periods) == 0 {
+		return nil, fmt.Errorf("invalid MPD: no Period")
+	}
+	return mpd, nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration parses an xs:duration like PT1H2M3.5S, years and months are not allowed in an MPD
+func parseDuration(s string) (time.Duration, error) {
+	match := isoDurationPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil || s == "P" || s == "PT" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	units := []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if match[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d += time.Duration(v * float64(unit))
+	}
+	return d, nil
+}
+
+// parseRange parses a first-last byte range into a length and an offset
+func parseRange(s string) (length uint64, offset uint64, err error) {
+	split := strings.Split(s, "-")
+	if len(split) != 2 {
+		return 0, 0, fmt.Errorf("invalid byte range %q", s)
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(split[0]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range %q", s)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(split[1]), 10, 64)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid byte range %q", s)
+	}
+	return last - first + 1, first, nil
+}
+
+var templatePattern = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)(%0(\d+)d)?\$|\$\$`)
+
+// expandTemplate substitutes the identifiers of a SegmentTemplate media or initialization attribute
+func expandTemplate(template string, rep *Representation, number uint64, t uint64) string {
+	return templatePattern.ReplaceAllStringFunc(template, func(s string) string {
+		if s == "$$" {
+			return "$"
+		}
+		match := templatePattern.FindStringSubmatch(s)
+		var value uint64
+		switch match[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Time":
+			value = t
+		case "Bandwidth":
+			value = uint64(rep.Bandwidth)
+		}
+		if match[3] != "" {
+			return fmt.Sprintf("%0"+match[3]+"d", value)
+		}
+		return strconv.FormatUint(value, 10)
+	})
+}
@@ -0,0 +1,569 @@
+package dash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+// FromURL loads an MPD like parse.FromURL loads a master playlist: the video representation is picked by
+// opts.Selector among the representations of the first video AdaptationSet, the audio representation with
+// the highest bandwidth of the first audio AdaptationSet becomes Result.Audio. opts may be nil.
+func FromURL(link string, headers map[string]string, uri *url.URL, opts *parse.Options) (*parse.Result, error) {
+	return FromURLContext(context.Background(), link, headers, uri, opts)
+}
+
+// FromURLContext is FromURL cancelled with ctx like parse.FromURLContext
+func FromURLContext(ctx context.Context, link string, headers map[string]string, uri *url.URL, opts *parse.Options) (*parse.Result, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	link = u.String()
+	body, err := opts.HTTPClient(uri).GetContext(ctx, link, headers)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("request MPD URL failed: %s", err.Error())
+	}
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+	return FromReaderContext(ctx, body, link, headers, uri, opts)
+}
+
+// FromReader loads an MPD obtained any other way, relative URLs are resolved against baseURL.
+// headers and opts.Client, or the proxy uri, are used to request the segment index of SegmentBase representations.
+func FromReader(reader io.Reader, baseURL string, headers map[string]string, uri *url.URL, opts *parse.Options) (*parse.Result, error) {
+	return FromReaderContext(context.Background(), reader, baseURL, headers, uri, opts)
+}
+
+// FromReaderContext is FromReader cancelled with ctx
+func FromReaderContext(ctx context.Context, reader io.Reader, baseURL string, headers map[string]string, uri *url.URL, opts *parse.Options) (*parse.Result, error) {
+	if opts == nil {
+		opts = &parse.Options{}
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %s", err.Error())
+	}
+	mpd, err := Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	if mpd.Type == "dynamic" {
+		return nil, errors.New("dynamic MPD is not supported, only on-demand presentations are")
+	}
+	periods, err := periodTimes(mpd)
+	if err != nil {
+		return nil, err
+	}
+	l := &loader{ctx: ctx, headers: headers, client: opts.HTTPClient(uri), base: resolveBase(u, mpd.BaseURL), selector: opts.Selector}
+	if l.selector == nil {
+		l.selector = parse.SelectFirst
+	}
+	video, err := l.track(periods, "video")
+	if err != nil {
+		return nil, err
+	}
+	audio, err := l.track(periods, "audio")
+	if err != nil {
+		return nil, err
+	}
+	if video == nil && audio == nil {
+		return nil, errors.New("MPD has no video or audio AdaptationSet")
+	}
+	result := &parse.Result{URL: u, Keys: make(map[int][]byte)}
+	if video == nil {
+		result.M3u8 = audio.m3u8
+		return result, nil
+	}
+	result.M3u8 = video.m3u8
+	result.Master = &parse.M3u8{MasterPlaylist: video.variants, Keys: make(map[int]*parse.Key)}
+	result.Variant = video.variant
+	if audio != nil {
+		result.Audio = &parse.Result{URL: u, M3u8: audio.m3u8, Keys: make(map[int][]byte)}
+	}
+	return result, nil
+}
+
+type period struct {
+	*Period
+	start    time.Duration
+	duration time.Duration
+}
+
+// periodTimes returns the start and duration of every Period, derived from the next Period
+// or the presentation duration when they are not given
+func periodTimes(mpd *MPD) ([]*period, error) {
+	var total time.Duration
+	if mpd.MediaPresentationDuration != "" {
+		d, err := parseDuration(mpd.MediaPresentationDuration)
+		if err != nil {
+			return nil, fmt.Errorf("mediaPresentationDuration: %s", err.Error())
+		}
+		total = d
+	}
+	periods := make([]*period, len(mpd.Periods))
+	var next time.Duration
+	for i, p := range mpd.Periods {
+		pd := &period{Period: p, start: next}
+		if p.Start != "" {
+			start, err := parseDuration(p.Start)
+			if err != nil {
+				return nil, fmt.Errorf("start of Period: %s", err.Error())
+			}
+			pd.start = start
+		}
+		if p.Duration != "" {
+			d, err := parseDuration(p.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("duration of Period: %s", err.Error())
+			}
+			pd.duration = d
+		}
+		if i > 0 && periods[i-1].duration == 0 {
+			periods[i-1].duration = pd.start - periods[i-1].start
+		}
+		periods[i] = pd
+		next = pd.start + pd.duration
+	}
+	if last := periods[len(periods)-1]; last.duration == 0 && total > last.start {
+		last.duration = total - last.start
+	}
+	return periods, nil
+}
+
+type loader struct {
+	ctx      context.Context
+	headers  map[string]string
+	client   *tool.Client
+	base     *url.URL
+	selector parse.VariantSelector
+}
+
+type track struct {
+	m3u8     *parse.M3u8
+	variants []*parse.MasterPlaylist // representations of the first Period
+	variant  *parse.MasterPlaylist   // the one selected in the first Period
+}
+
+// track concatenates the segments of the selected representation of every Period with content of the given type,
+// it returns nil if there is none
+func (l *loader) track(periods []*period, contentType string) (*track, error) {
+	var t *track
+	for _, p := range periods {
+		set := findAdaptationSet(p.Period, contentType)
+		if set == nil {
+			continue
+		}
+		variants := make([]*parse.MasterPlaylist, len(set.Representations))
+		for i, rep := range set.Representations {
+			variants[i] = variant(set, rep)
+		}
+		if len(variants) == 0 {
+			return nil, fmt.Errorf("%s AdaptationSet %q has no Representation", contentType, set.ID)
+		}
+		var selected *parse.MasterPlaylist
+		if contentType == "audio" {
+			selected = parse.SelectHighestBandwidth(variants)
+		} else {
+			selected = l.selector(variants)
+		}
+		if selected == nil {
+			return nil, errors.New("no representation matches the selection policy")
+		}
+		var rep *Representation
+		for i, v := range variants {
+			if v == selected {
+				rep = set.Representations[i]
+			}
+		}
+		segments, err := l.segments(p, set, rep)
+		if err != nil {
+			if l.ctx.Err() != nil {
+				return nil, l.ctx.Err()
+			}
+			return nil, fmt.Errorf("representation %q: %s", rep.ID, err.Error())
+		}
+		if len(segments) == 0 {
+			continue
+		}
+		if t == nil {
+			t = &track{
+				m3u8: &parse.M3u8{
+					Keys:         make(map[int]*parse.Key),
+					EndList:      true,
+					PlaylistType: parse.PlaylistTypeVOD,
+				},
+				variants: variants,
+				variant:  selected,
+			}
+		} else {
+			// Periods are encoded independently of each other
+			segments[0].Discontinuity = true
+		}
+		t.m3u8.Segments = append(t.m3u8.Segments, segments...)
+	}
+	if t == nil {
+		return nil, nil
+	}
+	for idx, seg := range t.m3u8.Segments {
+		seg.Sequence = uint64(idx)
+		if d := math.Ceil(float64(seg.Duration)); d > t.m3u8.TargetDuration {
+			t.m3u8.TargetDuration = d
+		}
+	}
+	return t, nil
+}
+
+// findAdaptationSet returns the first AdaptationSet of a Period with content of the given type, video or audio
+func findAdaptationSet(p *Period, contentType string) *AdaptationSet {
+	for _, set := range p.AdaptationSets {
+		kind := set.ContentType
+		if kind == "" {
+			kind = set.MimeType
+			if kind == "" && len(set.Representations) > 0 {
+				kind = set.Representations[0].MimeType
+			}
+		}
+		if strings.HasPrefix(kind, contentType) {
+			return set
+		}
+	}
+	return nil
+}
+
+// variant describes a representation like an EXT-X-STREAM-INF, for the parse.VariantSelector functions
+func variant(set *AdaptationSet, rep *Representation) *parse.MasterPlaylist {
+	v := &parse.MasterPlaylist{URI: rep.ID, BandWidth: rep.Bandwidth, Codecs: rep.Codecs}
+	if v.Codecs == "" {
+		v.Codecs = set.Codecs
+	}
+	if rep.Width > 0 && rep.Height > 0 {
+		v.Resolution = strconv.Itoa(rep.Width) + "x" + strconv.Itoa(rep.Height)
+	}
+	if split := strings.Split(rep.FrameRate, "/"); len(split) == 2 {
+		num, _ := strconv.ParseFloat(split[0], 64)
+		den, _ := strconv.ParseFloat(split[1], 64)
+		if den > 0 {
+			v.FrameRate = num / den
+		}
+	} else {
+		v.FrameRate, _ = strconv.ParseFloat(rep.FrameRate, 64)
+	}
+	return v
+}
+
+// segments lists the segments of a representation from the SegmentTemplate, SegmentList or SegmentBase
+// closest to it, the attributes it lacks are inherited from the AdaptationSet and the Period
+func (l *loader) segments(p *period, set *AdaptationSet, rep *Representation) ([]*parse.Segment, error) {
+	base := resolveBase(resolveBase(resolveBase(l.base, p.BaseURL), set.BaseURL), rep.BaseURL)
+	if tpl := mergeTemplates(p.SegmentTemplate, set.SegmentTemplate, rep.SegmentTemplate); tpl != nil {
+		return templateSegments(tpl, rep, base, p.duration)
+	}
+	if list := mergeLists(p.SegmentList, set.SegmentList, rep.SegmentList); list != nil {
+		return listSegments(list, base, p.duration)
+	}
+	if sb := mergeBases(p.SegmentBase, set.SegmentBase, rep.SegmentBase); sb != nil {
+		return l.baseSegments(sb, base)
+	}
+	// A single segment holding the whole representation
+	return []*parse.Segment{{URI: base.String(), Duration: float32(p.duration.Seconds())}}, nil
+}
+
+func templateSegments(tpl *SegmentTemplate, rep *Representation, base *url.URL, periodDuration time.Duration) ([]*parse.Segment, error) {
+	timescale, number, pto := uint64(1), uint64(1), uint64(0)
+	if tpl.Timescale != nil && *tpl.Timescale > 0 {
+		timescale = *tpl.Timescale
+	}
+	if tpl.StartNumber != nil {
+		number = *tpl.StartNumber
+	}
+	if tpl.PresentationTimeOffset != nil {
+		pto = *tpl.PresentationTimeOffset
+	}
+	if tpl.Media == "" {
+		return nil, errors.New("SegmentTemplate without media")
+	}
+	var init *parse.Map
+	if tpl.Initialization != "" {
+		init = &parse.Map{URI: resolve(base, expandTemplate(tpl.Initialization, rep, 0, 0))}
+	}
+	var segments []*parse.Segment
+	add := func(t, d uint64) {
+		segments = append(segments, &parse.Segment{
+			URI:      resolve(base, expandTemplate(tpl.Media, rep, number, t)),
+			Duration: float32(float64(d) / float64(timescale)),
+			Map:      init,
+		})
+		number++
+	}
+	periodEnd := pto + uint64(periodDuration.Seconds()*float64(timescale))
+	switch {
+	case tpl.SegmentTimeline != nil:
+		var t uint64
+		for i, s := range tpl.SegmentTimeline.S {
+			if s.T != nil {
+				t = *s.T
+			}
+			if s.D == 0 {
+				return nil, errors.New("SegmentTimeline S without d")
+			}
+			repeat := s.R
+			if repeat < 0 {
+				end := periodEnd
+				if i+1 < len(tpl.SegmentTimeline.S) && tpl.SegmentTimeline.S[i+1].T != nil {
+					end = *tpl.SegmentTimeline.S[i+1].T
+				}
+				if end <= t {
+					return nil, errors.New("SegmentTimeline S with r=-1 and an unknown end")
+				}
+				repeat = int64((end-t+s.D-1)/s.D) - 1
+			}
+			for j := int64(0); j <= repeat; j++ {
+				add(t, s.D)
+				t += s.D
+			}
+		}
+	case tpl.Duration != nil && *tpl.Duration > 0:
+		if periodDuration <= 0 {
+			return nil, errors.New("SegmentTemplate duration without a Period duration")
+		}
+		d := *tpl.Duration
+		for t := pto; t < periodEnd; t += d {
+			length := d
+			if t+d > periodEnd {
+				// The last segment ends with the Period
+				length = periodEnd - t
+			}
+			add(t, length)
+		}
+	default:
+		return nil, errors.New("SegmentTemplate without duration or SegmentTimeline")
+	}
+	return segments, nil
+}
+
+func listSegments(list *SegmentList, base *url.URL, periodDuration time.Duration) ([]*parse.Segment, error) {
+	timescale := uint64(1)
+	if list.Timescale != nil && *list.Timescale > 0 {
+		timescale = *list.Timescale
+	}
+	init, err := initialization(list.Initialization, base)
+	if err != nil {
+		return nil, err
+	}
+	var durations []uint64
+	if list.SegmentTimeline != nil {
+		for _, s := range list.SegmentTimeline.S {
+			for j := int64(0); j <= s.R; j++ {
+				durations = append(durations, s.D)
+			}
+		}
+	}
+	segments := make([]*parse.Segment, 0, len(list.SegmentURLs))
+	for i, su := range list.SegmentURLs {
+		seg := &parse.Segment{URI: base.String(), Map: init}
+		if su.Media != "" {
+			seg.URI = resolve(base, su.Media)
+		}
+		if su.MediaRange != "" {
+			if seg.Length, seg.Offset, err = parseRange(su.MediaRange); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case i < len(durations):
+			seg.Duration = float32(float64(durations[i]) / float64(timescale))
+		case list.Duration != nil:
+			seg.Duration = float32(float64(*list.Duration) / float64(timescale))
+		default:
+			seg.Duration = float32(periodDuration.Seconds() / float64(len(list.SegmentURLs)))
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// baseSegments requests the segment index of a single-file representation and lists its subsegments as byte ranges
+func (l *loader) baseSegments(sb *SegmentBase, base *url.URL) ([]*parse.Segment, error) {
+	if sb.IndexRange == "" {
+		return nil, errors.New("SegmentBase without indexRange")
+	}
+	length, offset, err := parseRange(sb.IndexRange)
+	if err != nil {
+		return nil, err
+	}
+	init, err := initialization(sb.Initialization, base)
+	if err != nil {
+		return nil, err
+	}
+	if init == nil && offset > 0 {
+		// The header boxes usually precede the index
+		init = &parse.Map{URI: base.String(), Length: offset}
+	}
+	index, err := l.client.GetRangeContext(l.ctx, base.String(), l.headers, offset, length)
+	if err != nil {
+		if l.ctx.Err() != nil {
+			return nil, l.ctx.Err()
+		}
+		return nil, fmt.Errorf("request segment index %s, %s", base, err.Error())
+	}
+	sidx, end, err := tool.ParseSegmentIndex(index)
+	if err != nil {
+		return nil, fmt.Errorf("segment index %s: %s", base, err.Error())
+	}
+	if sidx.Timescale == 0 {
+		return nil, fmt.Errorf("segment index %s: zero timescale", base)
+	}
+	pos := offset + uint64(end) + sidx.FirstOffset
+	segments := make([]*parse.Segment, 0, len(sidx.References))
+	for _, ref := range sidx.References {
+		segments = append(segments, &parse.Segment{
+			URI:      base.String(),
+			Duration: float32(float64(ref.Duration) / float64(sidx.Timescale)),
+			Length:   uint64(ref.Size),
+			Offset:   pos,
+			Map:      init,
+		})
+		pos += uint64(ref.Size)
+	}
+	return segments, nil
+}
+
+func initialization(i *URL, base *url.URL) (*parse.Map, error) {
+	if i == nil {
+		return nil, nil
+	}
+	m := &parse.Map{URI: base.String()}
+	if i.SourceURL != "" {
+		m.URI = resolve(base, i.SourceURL)
+	}
+	if i.Range != "" {
+		var err error
+		if m.Length, m.Offset, err = parseRange(i.Range); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func mergeTemplates(levels ...*SegmentTemplate) *SegmentTemplate {
+	var merged *SegmentTemplate
+	for _, t := range levels {
+		if t == nil {
+			continue
+		}
+		if merged == nil {
+			c := *t
+			merged = &c
+			continue
+		}
+		if t.Timescale != nil {
+			merged.Timescale = t.Timescale
+		}
+		if t.Duration != nil {
+			merged.Duration = t.Duration
+		}
+		if t.StartNumber != nil {
+			merged.StartNumber = t.StartNumber
+		}
+		if t.PresentationTimeOffset != nil {
+			merged.PresentationTimeOffset = t.PresentationTimeOffset
+		}
+		if t.Media != "" {
+			merged.Media = t.Media
+		}
+		if t.Initialization != "" {
+			merged.Initialization = t.Initialization
+		}
+		if t.SegmentTimeline != nil {
+			merged.SegmentTimeline = t.SegmentTimeline
+		}
+	}
+	return merged
+}
+
+func mergeLists(levels ...*SegmentList) *SegmentList {
+	var merged *SegmentList
+	for _, l := range levels {
+		if l == nil {
+			continue
+		}
+		if merged == nil {
+			c := *l
+			merged = &c
+			continue
+		}
+		if l.Timescale != nil {
+			merged.Timescale = l.Timescale
+		}
+		if l.Duration != nil {
+			merged.Duration = l.Duration
+		}
+		if l.Initialization != nil {
+			merged.Initialization = l.Initialization
+		}
+		if l.SegmentTimeline != nil {
+			merged.SegmentTimeline = l.SegmentTimeline
+		}
+		if len(l.SegmentURLs) > 0 {
+			merged.SegmentURLs = l.SegmentURLs
+		}
+	}
+	return merged
+}
+
+func mergeBases(levels ...*SegmentBase) *SegmentBase {
+	var merged *SegmentBase
+	for _, b := range levels {
+		if b == nil {
+			continue
+		}
+		if merged == nil {
+			c := *b
+			merged = &c
+			continue
+		}
+		if b.Timescale != nil {
+			merged.Timescale = b.Timescale
+		}
+		if b.IndexRange != "" {
+			merged.IndexRange = b.IndexRange
+		}
+		if b.Initialization != nil {
+			merged.Initialization = b.Initialization
+		}
+	}
+	return merged
+}
+
+// resolveBase applies the first BaseURL of an element to the base URL of its parent
+func resolveBase(parent *url.URL, baseURLs []string) *url.URL {
+	if len(baseURLs) == 0 {
+		return parent
+	}
+	ref, err := url.Parse(strings.TrimSpace(baseURLs[0]))
+	if err != nil {
+		return parent
+	}
+	return parent.ResolveReference(ref)
+}
+
+func resolve(base *url.URL, ref string) string {
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(r).String()
+}
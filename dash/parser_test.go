@@ -0,0 +1,118 @@
+package dash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+func TestFromReaderTemplates(t *testing.T) {
+	mpd := `<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT9.5S">
+  <BaseURL>media/</BaseURL>
+  <Period>
+    <AdaptationSet contentType="video">
+      <SegmentTemplate timescale="1000" duration="4000" startNumber="3"
+        initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number%04d$.m4s"/>
+      <Representation id="low" bandwidth="500000" width="640" height="360"/>
+      <Representation id="high" bandwidth="3000000" width="1920" height="1080"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4">
+      <SegmentTemplate timescale="48000" initialization="a/init.mp4" media="a/$Time$.m4s">
+        <SegmentTimeline>
+          <S t="0" d="192000" r="1"/>
+          <S d="72000"/>
+        </SegmentTimeline>
+      </SegmentTemplate>
+      <Representation id="aac" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := FromReader(strings.NewReader(mpd), "http://example.com/v/manifest.mpd", nil, nil,
+		&parse.Options{Selector: parse.SelectHighestBandwidth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Variant.URI != "high" || len(result.Master.MasterPlaylist) != 2 {
+		t.Fatalf("wrong variant: %+v", result.Variant)
+	}
+	segments := result.M3u8.Segments
+	if len(segments) != 3 || segments[0].URI != "http://example.com/v/media/high/0003.m4s" ||
+		segments[2].URI != "http://example.com/v/media/high/0005.m4s" || segments[2].Duration != 1.5 {
+		t.Fatalf("wrong video segments: %+v %+v", segments[0], segments[len(segments)-1])
+	}
+	if segments[0].Map == nil || segments[0].Map.URI != "http://example.com/v/media/high/init.mp4" {
+		t.Fatalf("wrong init section: %+v", segments[0].Map)
+	}
+	if result.Audio == nil {
+		t.Fatal("missing audio")
+	}
+	var uris []string
+	for _, seg := range result.Audio.M3u8.Segments {
+		uris = append(uris, strings.TrimPrefix(seg.URI, "http://example.com/v/media/a/"))
+	}
+	if strings.Join(uris, " ") != "0.m4s 192000.m4s 384000.m4s" {
+		t.Fatalf("wrong audio segments: %v", uris)
+	}
+}
+
+func TestFromReaderSegmentListAndBase(t *testing.T) {
+	// A sidx box referencing two subsegments of 1000 and 2000 bytes
+	var sidx bytes.Buffer
+	for _, v := range []interface{}{uint32(56), []byte("sidx"), uint32(0), uint32(1), uint32(1000),
+		uint32(0), uint32(0), uint16(0), uint16(2), uint32(1000), uint32(2000), uint32(0), uint32(2000), uint32(3000), uint32(0)} {
+		_ = binary.Write(&sidx, binary.BigEndian, v)
+	}
+	content := append(bytes.Repeat([]byte{0}, 800), sidx.Bytes()...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	mpd := `<MPD type="static" mediaPresentationDuration="PT10S">
+  <Period duration="PT5S">
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="1" bandwidth="1000">
+        <SegmentList timescale="10" duration="25">
+          <Initialization sourceURL="list.mp4" range="0-799"/>
+          <SegmentURL media="list.mp4" mediaRange="800-1799"/>
+          <SegmentURL media="list.mp4" mediaRange="1800-2999"/>
+        </SegmentList>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+  <Period>
+    <AdaptationSet mimeType="video/mp4">
+      <Representation id="2" bandwidth="1000">
+        <BaseURL>video.mp4</BaseURL>
+        <SegmentBase indexRange="800-855"><Initialization range="0-799"/></SegmentBase>
+      </Representation>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+	result, err := FromReader(strings.NewReader(mpd), server.URL+"/manifest.mpd", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := result.M3u8.Segments
+	if len(segments) != 4 {
+		t.Fatalf("wrong number of segments, expected: 4, result: %d", len(segments))
+	}
+	if segments[1].Offset != 1800 || segments[1].Length != 1200 || segments[1].Duration != 2.5 {
+		t.Fatalf("wrong SegmentList segment: %+v", segments[1])
+	}
+	base := segments[2:]
+	if !base[0].Discontinuity || base[0].Offset != 856 || base[0].Length != 1000 || base[0].Duration != 2 ||
+		base[1].Offset != 1856 || base[1].Length != 2000 || base[1].Duration != 3 {
+		t.Fatalf("wrong SegmentBase segments: %+v %+v", base[0], base[1])
+	}
+	if base[0].Map == nil || base[0].Map.Length != 800 || base[0].Map.URI != server.URL+"/video.mp4" {
+		t.Fatalf("wrong SegmentBase init section: %+v", base[0].Map)
+	}
+}
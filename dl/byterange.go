@@ -0,0 +1,92 @@
+package dl
+
+import (
+	"sync"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+// maxRangeGroupSize bounds the bytes fetched at once for contiguous EXT-X-BYTERANGE segments
+const maxRangeGroupSize = 16 << 20
+
+// rangeGroup is a run of contiguous sub-ranges of one resource, fetched with a single Range request
+// by the first of its segments to be downloaded and sliced by all of them
+type rangeGroup struct {
+	once    sync.Once
+	offset  uint64
+	length  uint64
+	pending int // segments not sliced out yet, the bytes are released when it drops to 0
+	bytes   []byte
+	err     error
+}
+
+// groupRanges finds the runs of segments whose byte ranges follow each other in the same resource
+func (d *Downloader) groupRanges() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.rangeGroups = make(map[int]*rangeGroup)
+	var (
+		group *rangeGroup
+		prev  *parse.Segment
+		start int
+	)
+	closeGroup := func(end int) {
+		if group != nil && end-start > 1 {
+			for idx := start; idx < end; idx++ {
+				d.rangeGroups[idx] = group
+			}
+		}
+		group = nil
+	}
+	for idx, seg := range d.result.M3u8.Segments {
+		contiguous := group != nil && seg.Length > 0 && !seg.Gap && seg.URI == prev.URI &&
+			seg.Offset == prev.Offset+prev.Length && group.length+seg.Length <= maxRangeGroupSize
+		if contiguous {
+			group.length += seg.Length
+			group.pending++
+		} else {
+			closeGroup(idx)
+			if seg.Length > 0 && !seg.Gap {
+				group = &rangeGroup{offset: seg.Offset, length: seg.Length, pending: 1}
+				start = idx
+			}
+		}
+		prev = seg
+	}
+	closeGroup(len(d.result.M3u8.Segments))
+}
+
+// fetchSegment returns the bytes of a segment, only its sub-range if it has an EXT-X-BYTERANGE
+func (d *Downloader) fetchSegment(segIndex int, tsUrl string) ([]byte, error) {
+	if bytes, ok := d.assembleParts(segIndex); ok {
+		return bytes, nil
+	}
+	seg := d.segment(segIndex)
+	if seg == nil || seg.Length == 0 {
+		return d.client().GetBytesContext(d.context(), tsUrl, d.headers)
+	}
+	d.lock.Lock()
+	group := d.rangeGroups[segIndex]
+	d.lock.Unlock()
+	if group != nil {
+		group.once.Do(func() {
+			group.bytes, group.err = d.client().GetRangeContext(d.context(), tsUrl, d.headers, group.offset, group.length)
+		})
+		d.lock.Lock()
+		var bytes []byte
+		if group.err == nil && uint64(len(group.bytes)) >= seg.Offset-group.offset+seg.Length {
+			start := seg.Offset - group.offset
+			bytes = append([]byte(nil), group.bytes[start:start+seg.Length]...)
+			group.pending--
+			if group.pending <= 0 {
+				group.bytes = nil
+			}
+		}
+		d.lock.Unlock()
+		if bytes != nil {
+			return bytes, nil
+		}
+		// The group request failed or its bytes were released already, fetch the segment on its own
+	}
+	return d.client().GetRangeContext(d.context(), tsUrl, d.headers, seg.Offset, seg.Length)
+}
@@ -0,0 +1,62 @@
+package dl
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+func TestFetchByteRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "main.ts", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	m, err := parse.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXTINF:10,
+#EXT-X-BYTERANGE:100@0
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:200
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:50
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:100@800
+main.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL + "/index.m3u8")
+	d := &Downloader{result: &parse.Result{URL: u, M3u8: m}}
+	d.groupRanges()
+	if len(d.rangeGroups) != 3 || d.rangeGroups[3] != nil {
+		t.Fatalf("wrong range groups: %v", d.rangeGroups)
+	}
+	for idx, seg := range m.Segments {
+		b, err := d.fetchSegment(idx, d.tsURL(idx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content[seg.Offset:seg.Offset+seg.Length]) {
+			t.Fatalf("wrong bytes of segment %d: %q", idx, b)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("wrong number of requests, expected: 2, result: %d", requests)
+	}
+}
@@ -0,0 +1,179 @@
+package dl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+// Clip selects a time window of a VOD, only the segments covering it are downloaded
+type Clip struct {
+	Start time.Duration // offset from the start of the playlist
+	End   time.Duration // offset from the start of the playlist, 0 means until the end
+	// StartTime and EndTime are wall-clock bounds mapped to offsets through EXT-X-PROGRAM-DATE-TIME,
+	// they replace Start and End when set.
+	StartTime time.Time
+	EndTime   time.Time
+	// Precise trims the merged file to the exact window with ffmpeg, re-encoding it,
+	// otherwise the first and last covering segments are kept whole.
+	Precise bool
+}
+
+// applyClip drops the segments outside the clip window, it must run before any segment is queued for download
+func (d *Downloader) applyClip() error {
+	if d.Live && !d.result.M3u8.EndList {
+		// A playlist with EXT-X-ENDLIST is downloaded as a VOD even with Live set
+		return fmt.Errorf("clipping needs a VOD playlist, not a live recording")
+	}
+	segments := d.result.M3u8.Segments
+	from, to, err := clipWindow(segments, d.Clip)
+	if err != nil {
+		return err
+	}
+	first, last := clipSegments(segments, from, to)
+	if first > last {
+		return fmt.Errorf("no segment between %s and %s", from, to)
+	}
+	starts := segmentStarts(segments)
+	d.clipOffset = from - starts[first]
+	d.clipLength = to - from
+	if d.Clip.End == 0 && d.Clip.EndTime.IsZero() {
+		d.clipLength = 0
+	}
+	d.clipped = true
+	d.result.M3u8.Segments = segments[first : last+1]
+	d.segLen = len(d.result.M3u8.Segments)
+	d.queue = genSlice(d.segLen)
+	fmt.Printf("[clip] segments %d to %d of %d\n", first, last, len(segments))
+	if d.audio != nil {
+		// The audio rendition has its own segment boundaries, clip it by offset,
+		// muxAudio makes up for the different starts of the first segments
+		d.audio.Clip = &Clip{Start: from, End: to, Precise: d.Clip.Precise}
+		if d.clipLength == 0 {
+			d.audio.Clip.End = 0
+		}
+		return d.audio.applyClip()
+	}
+	return nil
+}
+
+// trimClip cuts the merged file down to the exact clip window
+func (d *Downloader) trimClip() error {
+	if d.Clip == nil || !d.Clip.Precise || d.clipOffset == 0 && d.clipLength == 0 {
+		return nil
+	}
+	mergePath := filepath.Join(d.folder, d.GetMergeFilename())
+	trimPath := mergePath + tsTempFileSuffix + d.GetExt()
+	args := []string{"-y", "-ss", formatSeconds(d.clipOffset), "-i", mergePath}
+	if d.clipLength > 0 {
+		args = append(args, "-t", formatSeconds(d.clipLength))
+	}
+	args = append(args, "-c:v", "libx264", "-preset", "superfast", "-c:a", "aac", trimPath)
+	if err := CmdArrContext(d.context(), d.GetFFmpeg(), args); err != nil {
+		return fmt.Errorf("trim %s: %s", mergePath, err.Error())
+	}
+	return os.Rename(trimPath, mergePath)
+}
+
+// clipWindow returns the clip bounds as offsets from the start of the playlist
+func clipWindow(segments []*parse.Segment, c *Clip) (from time.Duration, to time.Duration, err error) {
+	starts := segmentStarts(segments)
+	total := starts[len(starts)-1]
+	from, to = c.Start, c.End
+	if !c.StartTime.IsZero() || !c.EndTime.IsZero() {
+		walls := segmentWallClock(segments)
+		if walls == nil {
+			return 0, 0, fmt.Errorf("wall-clock clipping needs EXT-X-PROGRAM-DATE-TIME in the playlist")
+		}
+		if !c.StartTime.IsZero() {
+			from = wallClockOffset(segments, starts, walls, c.StartTime)
+		}
+		if !c.EndTime.IsZero() {
+			to = wallClockOffset(segments, starts, walls, c.EndTime)
+		}
+	}
+	if to > total || to == 0 && c.EndTime.IsZero() {
+		to = total
+	}
+	if from >= total {
+		return 0, 0, fmt.Errorf("clip start %s beyond the end of the playlist at %s", from, total)
+	}
+	if from < 0 || to <= from {
+		return 0, 0, fmt.Errorf("invalid clip window %s to %s", from, to)
+	}
+	return from, to, nil
+}
+
+// clipSegments returns the indexes of the first and last segment overlapping [from, to)
+func clipSegments(segments []*parse.Segment, from, to time.Duration) (first int, last int) {
+	starts := segmentStarts(segments)
+	first, last = len(segments), -1
+	for idx := range segments {
+		if starts[idx+1] > from && starts[idx] < to {
+			if idx < first {
+				first = idx
+			}
+			last = idx
+		}
+	}
+	return first, last
+}
+
+// segmentStarts returns the offset of each segment from the start of the playlist,
+// followed by the duration of the whole playlist
+func segmentStarts(segments []*parse.Segment) []time.Duration {
+	starts := make([]time.Duration, len(segments)+1)
+	for idx, seg := range segments {
+		starts[idx+1] = starts[idx] + time.Duration(float64(seg.Duration)*float64(time.Second))
+	}
+	return starts
+}
+
+// segmentWallClock returns the date and time of each segment, taken from its EXT-X-PROGRAM-DATE-TIME
+// or carried over from the previous segment, or nil if the playlist has no EXT-X-PROGRAM-DATE-TIME
+func segmentWallClock(segments []*parse.Segment) []time.Time {
+	walls := make([]time.Time, len(segments))
+	found := false
+	for idx, seg := range segments {
+		switch {
+		case !seg.ProgramDateTime.IsZero():
+			walls[idx] = seg.ProgramDateTime
+			found = true
+		case idx > 0 && !walls[idx-1].IsZero():
+			walls[idx] = walls[idx-1].Add(time.Duration(float64(segments[idx-1].Duration) * float64(time.Second)))
+		}
+	}
+	if !found {
+		return nil
+	}
+	// Segments ahead of the first EXT-X-PROGRAM-DATE-TIME are dated backwards from it
+	for idx := len(segments) - 2; idx >= 0; idx-- {
+		if walls[idx].IsZero() && !walls[idx+1].IsZero() {
+			walls[idx] = walls[idx+1].Add(-time.Duration(float64(segments[idx].Duration) * float64(time.Second)))
+		}
+	}
+	return walls
+}
+
+// wallClockOffset maps a date and time to an offset from the start of the playlist,
+// dates outside the playlist are clamped to its start or end
+func wallClockOffset(segments []*parse.Segment, starts []time.Duration, walls []time.Time, t time.Time) time.Duration {
+	if t.Before(walls[0]) {
+		return 0
+	}
+	for idx := range segments {
+		length := starts[idx+1] - starts[idx]
+		if !t.Before(walls[idx]) && t.Before(walls[idx].Add(length)) {
+			return starts[idx] + t.Sub(walls[idx])
+		}
+	}
+	return starts[len(starts)-1]
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,91 @@
+package dl
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+func TestClipWindow(t *testing.T) {
+	m, err := parse.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-PROGRAM-DATE-TIME:2020-01-02T21:55:40.000Z
+#EXTINF:10,
+0.ts
+#EXTINF:10,
+1.ts
+#EXTINF:10,
+2.ts
+#EXTINF:10,
+3.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, _ := time.Parse(time.RFC3339, "2020-01-02T21:55:55Z")
+	tests := []struct {
+		clip        Clip
+		from, to    time.Duration
+		first, last int
+	}{
+		{Clip{Start: 12 * time.Second, End: 25 * time.Second}, 12 * time.Second, 25 * time.Second, 1, 2},
+		{Clip{Start: 20 * time.Second}, 20 * time.Second, 40 * time.Second, 2, 3},
+		{Clip{StartTime: start, End: 30 * time.Second}, 15 * time.Second, 30 * time.Second, 1, 2},
+	}
+	for _, test := range tests {
+		from, to, err := clipWindow(m.Segments, &test.clip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != test.from || to != test.to {
+			t.Fatalf("window %+v is %s to %s, want %s to %s", test.clip, from, to, test.from, test.to)
+		}
+		if first, last := clipSegments(m.Segments, from, to); first != test.first || last != test.last {
+			t.Fatalf("segments of %+v are %d to %d, want %d to %d", test.clip, first, last, test.first, test.last)
+		}
+	}
+	if _, _, err := clipWindow(m.Segments, &Clip{Start: time.Minute}); err == nil {
+		t.Fatal("expected an error for a start beyond the end")
+	}
+}
+
+func TestMuxAudioArgs(t *testing.T) {
+	tests := []struct {
+		clip                     *Clip
+		videoOffset, audioOffset time.Duration
+		expected                 string
+	}{
+		{nil, 0, 0, "-y -i v.ts -i a.ts"},
+		{&Clip{}, 5 * time.Second, 3 * time.Second, "-y -i v.ts -itsoffset 2.000 -i a.ts"},
+		{&Clip{}, 3 * time.Second, 4500 * time.Millisecond, "-y -i v.ts -ss 1.500 -i a.ts"},
+		{&Clip{Precise: true}, 3 * time.Second, 5 * time.Second, "-y -i v.ts -i a.ts"},
+	}
+	for _, test := range tests {
+		d := &Downloader{Clip: test.clip, clipOffset: test.videoOffset, audio: &Downloader{clipOffset: test.audioOffset}}
+		args := strings.Join(d.muxAudioArgs("v.ts", "a.ts", "mux.ts"), " ")
+		if !strings.HasPrefix(args, test.expected+" -map") {
+			t.Fatalf("wrong arguments for video at %s and audio at %s, expected: %s, result: %s", test.videoOffset, test.audioOffset, test.expected, args)
+		}
+	}
+}
+
+func TestApplyClipLive(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\n0.ts\n#EXTINF:10,\n1.ts\n"
+	for _, ended := range []bool{false, true} {
+		text := playlist
+		if ended {
+			text += "#EXT-X-ENDLIST\n"
+		}
+		m, err := parse.Parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &Downloader{result: &parse.Result{M3u8: m}, Live: true, Clip: &Clip{Start: 12 * time.Second}}
+		if err := d.applyClip(); (err == nil) != ended {
+			t.Fatalf("clip of a live playlist, ended: %t, result: %v", ended, err)
+		}
+	}
+}
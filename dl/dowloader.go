@@ -2,9 +2,11 @@ package dl
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"os/exec"
@@ -26,6 +28,9 @@ import (
 const (
 	// tsExt            = ".mp4"
 	tsFolderName = "ts"
+	// audio renditions are downloaded next to the video segments
+	audioTsFolderName  = "ts_audio"
+	audioMergeFilename = "audio.ts"
 	// mergeTSFilename  = "main.mp4"
 	tsTempFileSuffix = "_tmp"
 	progressWidth    = 40
@@ -45,17 +50,53 @@ type Downloader struct {
 	WaterMarkerLeft   int
 	VideoWidth        int
 	VideoHeight       int
-	WaterMakerType    int // 0.loop  1.fix prefix -1.no mark
-	ProxyUrl          string
-	UploadFunc        func(fp string)
-	ProcessFunc       func(finish int32, total int, u string)
-	result            *parse.Result
-	CheckTsFunc       func(tsFile string, hkey string, sizeMap map[string]string) bool
-	CheckTsKey        string
-	CheckTsMap        map[string]string
-	AdFileInfo        map[int64]string // key:文件大小；val:md5
-	SubTitle          string
-	FFmpegPath        string
+	WaterMakerType    int          // 0.loop  1.fix prefix -1.no mark
+	ProxyUrl          string       // http, https, socks5 or socks5h proxy, optionally with credentials
+	Client            *tool.Client // sends the segment requests, through ProxyUrl if it is set
+	proxied           *tool.Client // Client through ProxyUrl
+	// Limits throttles the segment requests of the task, video and audio together,
+	// in place of the limits of Client
+	Limits        tool.Limits
+	limited       *tool.Client
+	UploadFunc    func(fp string) // receives every downloaded segment file, audio included, instead of merging
+	ProcessFunc   func(finish int32, total int, u string)
+	result        *parse.Result
+	CheckTsFunc   func(tsFile string, hkey string, sizeMap map[string]string) bool
+	CheckTsKey    string
+	CheckTsMap    map[string]string
+	AdFileInfo    map[int64]string // key:文件大小；val:md5
+	SubTitle      string
+	FFmpegPath    string
+	mergeFilename string
+	audio         *Downloader // separate EXT-X-MEDIA audio rendition, muxed after merging
+	opts          *parse.Options
+	written       int64 // bytes of segments written to the ts folder
+	// Live keeps reloading playlists without EXT-X-ENDLIST and records the new segments,
+	// until the playlist ends, a limit below is reached or Stop is called.
+	Live              bool
+	MaxRecordDuration time.Duration // 0 means no limit
+	MaxRecordSize     int64         // bytes of video segments, 0 means no limit
+	recording         bool
+	recorded          time.Duration
+	lastSeq           uint64
+	stop              chan struct{}
+	stopOnce          sync.Once
+	parts             map[string]*livePart // EXT-X-PART parts of the incomplete live segment by URL and byte range
+	segParts          map[int][]*livePart  // parts of complete live segments by segment index
+	initTracks        map[*parse.Map]map[uint32]*tool.TrackEncryption
+	// Clip downloads only a time window of a VOD, nil downloads every segment
+	Clip       *Clip
+	clipped    bool
+	clipOffset time.Duration // start of the window in the first kept segment
+	clipLength time.Duration // 0 keeps everything after clipOffset
+	// contiguous EXT-X-BYTERANGE segments by segment index
+	rangeGroups map[int]*rangeGroup
+	// Retry controls how failed segments are retried, nil uses DefaultRetryPolicy
+	Retry    *RetryPolicy
+	attempts map[int]int
+	failed   map[int]*SegmentFailure
+	ctx      context.Context // of StartContext
+	limit    chan struct{}   // slots of the concurrent segment downloads, shared with the audio rendition
 }
 
 func (d *Downloader) GetExt() string {
@@ -70,6 +111,9 @@ func (d *Downloader) GetFFmpeg() string {
 }
 
 func (d *Downloader) GetMergeFilename() string {
+	if len(d.mergeFilename) > 0 {
+		return d.mergeFilename
+	}
 	return "main.ts"
 }
 
@@ -93,11 +137,49 @@ func (d *Downloader) GetDuration() int {
 
 // NewTask returns a Task instance
 func NewTask(output string, url string, headers map[string]string, uri *url.URL) (*Downloader, error) {
-	result, err := parse.FromURL(url, headers, uri)
+	return NewTaskWithOptions(output, url, headers, uri, nil)
+}
+
+// NewTaskWithOptions returns a Task instance, opts controls how the playlist is loaded and may be nil
+func NewTaskWithOptions(output string, url string, headers map[string]string, uri *url.URL, opts *parse.Options) (*Downloader, error) {
+	return NewTaskContext(context.Background(), output, url, headers, uri, opts)
+}
+
+// NewTaskContext is NewTaskWithOptions loading the playlist with parse.FromURLContext
+func NewTaskContext(ctx context.Context, output string, url string, headers map[string]string, uri *url.URL, opts *parse.Options) (*Downloader, error) {
+	if opts == nil {
+		opts = &parse.Options{}
+	}
+	if opts.Client == nil || opts.KeyProvider == nil {
+		o := *opts
+		if o.Client == nil {
+			// One pool of connections and cookies for the playlists, keys and segments of the task
+			jar, _ := cookiejar.New(nil)
+			o.Client = tool.NewClient(tool.ClientOptions{Proxy: uri, Jar: jar})
+		}
+		if o.KeyProvider == nil {
+			// Share one key cache between the media playlists and their reloads
+			o.KeyProvider = parse.DefaultKeyProviderWithClient(o.Client, nil)
+		}
+		opts = &o
+	}
+	result, err := parse.FromURLContext(ctx, url, headers, uri, opts)
 
 	if err != nil {
 		return nil, err
 	}
+	return NewTaskFromPlaylist(output, result, headers, opts)
+}
+
+// NewTaskFromPlaylist returns a Task instance downloading an already loaded playlist, e.g. one from
+// parse.FromFile. headers are sent with every segment request, opts is used to reload live playlists and may be nil.
+func NewTaskFromPlaylist(output string, result *parse.Result, headers map[string]string, opts *parse.Options) (*Downloader, error) {
+	if result == nil || result.M3u8 == nil {
+		return nil, fmt.Errorf("no media playlist to download")
+	}
+	if result.Keys == nil {
+		result.Keys = make(map[int][]byte)
+	}
 	var folder string
 	// If no output folder specified, use current directory
 	if output == "" {
@@ -121,23 +203,112 @@ func NewTask(output string, url string, headers map[string]string, uri *url.URL)
 		tsFolder: tsFolder,
 		result:   result,
 		headers:  headers,
+		opts:     opts,
+		stop:     make(chan struct{}),
+	}
+	if opts != nil {
+		d.Client = opts.Client
 	}
 	d.segLen = len(result.M3u8.Segments)
 	d.queue = genSlice(d.segLen)
+	if result.Audio != nil {
+		audioFolder := filepath.Join(folder, audioTsFolderName)
+		if err := os.MkdirAll(audioFolder, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("create audio ts folder '[%s]' failed: %s", audioFolder, err.Error())
+		}
+		d.audio = &Downloader{
+			folder:         folder,
+			tsFolder:       audioFolder,
+			result:         result.Audio,
+			headers:        headers,
+			WaterMakerType: -1,
+			mergeFilename:  audioMergeFilename,
+			opts:           opts,
+			stop:           make(chan struct{}),
+			Client:         d.Client,
+		}
+		d.audio.segLen = len(result.Audio.M3u8.Segments)
+		d.audio.queue = genSlice(d.audio.segLen)
+	}
 	return d, nil
 }
 
 // Start runs downloader
 func (d *Downloader) Start(concurrency int, parseUrl func(string) string) error {
-	var wg sync.WaitGroup
-	// struct{} zero size
-	limitChan := make(chan struct{}, concurrency)
-	for {
+	return d.StartContext(context.Background(), concurrency, parseUrl)
+}
+
+// StartContext is Start cancelled with ctx: once ctx is done no segment is scheduled anymore, the requests
+// in flight are aborted, running ffmpeg processes are killed and ctx.Err() is returned without merging.
+func (d *Downloader) StartContext(ctx context.Context, concurrency int, parseUrl func(string) string) error {
+	d.ctx = ctx
+	if len(d.ProxyUrl) > 0 && d.proxied == nil {
+		proxyUri, err := tool.ParseProxy(d.ProxyUrl)
+		if err != nil {
+			return err
+		}
+		if d.Client != nil {
+			// Keep the cookies and options of Client
+			d.proxied = d.Client.WithProxy(proxyUri)
+		} else {
+			d.proxied = tool.ProxyClient(proxyUri)
+		}
+	}
+	if d.Limits != (tool.Limits{}) && d.limited == nil {
+		d.limited = d.client().WithLimits(d.Limits)
+	}
+	if d.limit == nil {
+		// struct{} zero size
+		d.limit = make(chan struct{}, concurrency)
+	}
+	if d.audio != nil {
+		d.audio.proxied = d.proxied
+		if d.limited != nil {
+			d.audio.limited = d.limited
+		}
+		// concurrency bounds the video and audio downloads together
+		d.audio.limit = d.limit
+	}
+	if d.Clip != nil && !d.clipped {
+		if err := d.applyClip(); err != nil {
+			return err
+		}
+	}
+	d.groupRanges()
+	if err := d.downloadInitSections(); err != nil {
+		return err
+	}
+	var (
+		wg       sync.WaitGroup
+		audioErr = make(chan error, 1)
+	)
+	if d.audio != nil {
+		// The audio rendition is downloaded alongside the video, a live one has to be recorded at the same time
+		d.audio.ProxyUrl = d.ProxyUrl
+		d.audio.Client = d.Client
+		d.audio.Retry = d.Retry
+		d.audio.FFmpegPath = d.FFmpegPath
+		d.audio.Live = d.Live
+		d.audio.UploadFunc = d.UploadFunc
+		if d.Live {
+			d.audio.MaxRecordDuration = d.MaxRecordDuration
+		}
+		go func() {
+			audioErr <- d.audio.StartContext(ctx, concurrency, parseUrl)
+		}()
+	}
+	if d.Live && !d.result.M3u8.EndList {
+		d.startRecording()
+	}
+	limitChan := d.limit
+	for ctx.Err() == nil {
 		tsIdx, end, err := d.next()
 		if err != nil {
 			if end {
 				break
 			}
+			// Wait for running segments or the next playlist reload
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 		wg.Add(1)
@@ -148,23 +319,35 @@ func (d *Downloader) Start(concurrency int, parseUrl func(string) string) error
 				<-limitChan
 			}()
 			if err := d.download(idx, parseUrl); err != nil {
-				// Back into the queue, retry request
-				fmt.Printf("[failed] %s\n", err.Error())
-				if strings.HasPrefix(err.Error(), "decryt") {
+				if ctx.Err() != nil {
 					return
 				}
-				if strings.HasPrefix(err.Error(), "no such file or directory") {
-					return
-				}
-				if err := d.back(idx); err != nil {
-					fmt.Println(err.Error())
-				}
-
+				// Back into the queue after a delay if the error is retriable
+				fmt.Printf("[failed] %s\n", err.Error())
+				d.retry(idx, err)
 			}
 		}(tsIdx)
 
 	}
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		if d.audio != nil {
+			<-audioErr
+		}
+		return err
+	}
+	d.reportFailures()
+	if d.audio != nil {
+		if d.Live {
+			d.audio.Stop()
+		}
+		if err := <-audioErr; err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("download audio rendition: %s", err.Error())
+		}
+	}
 	if d.UploadFunc != nil {
 		// 已上传ts文件，无需合并
 		_ = os.RemoveAll(d.tsFolder)
@@ -180,13 +363,60 @@ func (d *Downloader) Start(concurrency int, parseUrl func(string) string) error
 			return err
 		}
 	}
+	if err := d.trimClip(); err != nil {
+		return err
+	}
+	if d.audio != nil {
+		return d.muxAudio()
+	}
 
 	return nil
 }
 
+// muxAudio combines the merged video with the merged audio rendition into the merge file
+func (d *Downloader) muxAudio() error {
+	videoPath := filepath.Join(d.folder, d.GetMergeFilename())
+	audioPath := filepath.Join(d.folder, d.audio.GetMergeFilename())
+	muxPath := videoPath + tsTempFileSuffix + d.GetExt()
+	err := CmdArrContext(d.context(), d.GetFFmpeg(), d.muxAudioArgs(videoPath, audioPath, muxPath))
+	if err != nil {
+		return fmt.Errorf("mux audio rendition: %s", err.Error())
+	}
+	if err := os.Rename(muxPath, videoPath); err != nil {
+		return err
+	}
+	_ = os.Remove(audioPath)
+	fmt.Printf("[output] %s muxed with %s\n", videoPath, audioPath)
+	return nil
+}
+
+// muxAudioArgs returns the ffmpeg arguments of muxAudio. The segments of a clip without Precise are kept
+// whole, the audio is shifted by the difference between the starts of its first segment and the video's.
+func (d *Downloader) muxAudioArgs(videoPath, audioPath, muxPath string) []string {
+	args := []string{"-y", "-i", videoPath}
+	if d.Clip != nil && !d.Clip.Precise {
+		switch offset := d.clipOffset - d.audio.clipOffset; {
+		case offset > 0:
+			// The first audio segment starts after the first video segment
+			args = append(args, "-itsoffset", formatSeconds(offset))
+		case offset < 0:
+			args = append(args, "-ss", formatSeconds(-offset))
+		}
+	}
+	return append(args, "-i", audioPath, "-map", "0:v", "-map", "1:a", "-c", "copy", muxPath)
+}
+
 func (d *Downloader) download(segIndex int, parseUrl func(url string) string) error {
 	tsFilename := d.tsFilename(segIndex)
-
+	sf := d.segment(segIndex)
+	if sf == nil {
+		return fmt.Errorf("invalid segment index: %d", segIndex)
+	}
+	if sf.Gap {
+		// EXT-X-GAP, the segment is missing and must not be loaded
+		atomic.AddInt32(&d.finish, 1)
+		return nil
+	}
 	tsUrl := d.tsURL(segIndex)
 	if parseUrl != nil {
 		tsUrl = parseUrl(tsUrl)
@@ -194,10 +424,10 @@ func (d *Downloader) download(segIndex int, parseUrl func(url string) string) er
 	if tsUrl == "ad_ts" {
 		// 广告，需要过滤掉
 		fmt.Println(tsUrl, "is a ad ts, ignore this ts")
-		atomic.AddInt32(&d.finish, 1)
-		fmt.Printf("[download %6.2f%%] %s\n", float32(d.finish)/float32(d.segLen)*100, tsUrl)
+		finish := atomic.AddInt32(&d.finish, 1)
+		fmt.Printf("[download %6.2f%%] %s\n", float32(finish)/float32(d.total())*100, tsUrl)
 		if d.ProcessFunc != nil {
-			d.ProcessFunc(d.finish, d.segLen, tsUrl)
+			d.ProcessFunc(finish, d.total(), tsUrl)
 		}
 		return nil
 	}
@@ -215,10 +445,10 @@ func (d *Downloader) download(segIndex int, parseUrl func(url string) string) er
 				if m1 == m {
 					// 广告
 					fmt.Println(tsUrl, "is a ad ts, ignore this ts, fileSize is", fsize)
-					atomic.AddInt32(&d.finish, 1)
-					fmt.Printf("[download %6.2f%%] %s\n", float32(d.finish)/float32(d.segLen)*100, tsUrl)
+					finish := atomic.AddInt32(&d.finish, 1)
+					fmt.Printf("[download %6.2f%%] %s\n", float32(finish)/float32(d.total())*100, tsUrl)
 					if d.ProcessFunc != nil {
-						d.ProcessFunc(d.finish, d.segLen, tsUrl)
+						d.ProcessFunc(finish, d.total(), tsUrl)
 					}
 					return nil
 				}
@@ -228,11 +458,11 @@ func (d *Downloader) download(segIndex int, parseUrl func(url string) string) er
 		if d.CheckTsFunc != nil && len(d.CheckTsKey) > 0 {
 			if d.CheckTsFunc(fPath, d.CheckTsKey, d.CheckTsMap) {
 				// Maybe it will be safer in this way...
-				atomic.AddInt32(&d.finish, 1)
-				// tool.DrawProgressBar("Downloading", float32(d.finish)/float32(d.segLen), progressWidth)
-				fmt.Printf("[download %6.2f%%] %s\n", float32(d.finish)/float32(d.segLen)*100, tsUrl)
+				finish := atomic.AddInt32(&d.finish, 1)
+				// tool.DrawProgressBar("Downloading", float32(d.finish)/float32(d.total()), progressWidth)
+				fmt.Printf("[download %6.2f%%] %s\n", float32(finish)/float32(d.total())*100, tsUrl)
 				if d.ProcessFunc != nil {
-					d.ProcessFunc(d.finish, d.segLen, tsUrl)
+					d.ProcessFunc(finish, d.total(), tsUrl)
 				}
 				return nil
 			} else {
@@ -240,61 +470,19 @@ func (d *Downloader) download(segIndex int, parseUrl func(url string) string) er
 			}
 		}
 	}
-	var proxyUri *url.URL
-	if len(d.ProxyUrl) > 0 {
-		proxyUri, _ = url.Parse(d.ProxyUrl)
-	}
-	bytes, e := tool.GetBytesByProxy(tsUrl, d.headers, proxyUri)
-	if e != nil {
-		fmt.Println(e.Error())
-		if strings.Contains(e.Error(), "429") {
-			time.Sleep(time.Duration(3) * time.Second)
-		}
-		if strings.Contains(e.Error(), "fatal") {
-			atomic.AddInt32(&d.finish, 1)
-			return nil
-		}
-		return fmt.Errorf("request %s, %s", tsUrl, e.Error())
-	}
-	//noinspection GoUnhandledErrorResult
-
 	fTemp := fPath + tsTempFileSuffix
-	f, err := os.Create(fTemp)
-	if err != nil {
-		return fmt.Errorf("create file: %s, %s", tsFilename, err.Error())
-	}
-	sf := d.result.M3u8.Segments[segIndex]
-	if sf == nil {
-		return fmt.Errorf("invalid segment index: %d", segIndex)
-	}
-	key, ok := d.result.Keys[sf.KeyIndex]
-	if ok && key != "" {
-		tempBytes, err := tool.AES128Decrypt(bytes, []byte(key),
-			[]byte(d.result.M3u8.Keys[sf.KeyIndex].IV), tsUrl)
-		if err != nil {
-			// return fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
-		} else {
-			bytes = tempBytes
-		}
-	}
-	// https://en.wikipedia.org/wiki/MPEG_transport_stream
-	// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
-	// Need to remove the bytes before the SyncByte 0x47(71).
-	syncByte := uint8(71) //0x47
-	bLen := len(bytes)
-	for j := 0; j < bLen; j++ {
-		if bytes[j] == syncByte {
-			bytes = bytes[j:]
-			break
-		}
+	var written int64
+	if d.streamable(segIndex, sf) {
+		written, err = d.streamSegment(sf, tsUrl, fTemp)
+	} else {
+		written, err = d.bufferSegment(segIndex, sf, tsUrl, fTemp)
 	}
-	w := bufio.NewWriter(f)
-	if _, err := w.Write(bytes); err != nil {
-		return fmt.Errorf("write to %s: %s", fTemp, err.Error())
+	if err != nil {
+		_ = os.Remove(fTemp)
+		return err
 	}
-	// Release file resource to rename file
-	_ = f.Close()
-	finfo := Info(d.GetFFmpeg(), fTemp)
+	atomic.AddInt64(&d.written, written)
+	finfo := InfoContext(d.context(), d.GetFFmpeg(), fTemp)
 	if segIndex == 0 {
 		d.VideoWidth = finfo.Width
 		d.VideoHeight = finfo.Height
@@ -315,15 +503,80 @@ func (d *Downloader) download(segIndex int, parseUrl func(url string) string) er
 	}
 
 	// Maybe it will be safer in this way...
-	atomic.AddInt32(&d.finish, 1)
-	//tool.DrawProgressBar("Downloading", float32(d.finish)/float32(d.segLen), progressWidth)
-	fmt.Printf("[download %6.2f%%] %s\n", float32(d.finish)/float32(d.segLen)*100, tsUrl)
+	finish := atomic.AddInt32(&d.finish, 1)
+	//tool.DrawProgressBar("Downloading", float32(d.finish)/float32(d.total()), progressWidth)
+	fmt.Printf("[download %6.2f%%] %s\n", float32(finish)/float32(d.total())*100, tsUrl)
 	if d.ProcessFunc != nil {
-		d.ProcessFunc(d.finish, d.segLen, tsUrl)
+		d.ProcessFunc(finish, d.total(), tsUrl)
+	}
+	return nil
+}
+
+// downloadInitSections fetches every distinct EXT-X-MAP of the playlist into the ts folder,
+// merge writes them in front of the segments they initialize.
+func (d *Downloader) downloadInitSections() error {
+	var last *parse.Map
+	for _, seg := range d.segments() {
+		if seg.Map == nil || seg.Map == last {
+			continue
+		}
+		last = seg.Map
+		fPath := filepath.Join(d.tsFolder, d.initFilename(seg.Map))
+		if _, err := os.Stat(fPath); err == nil {
+			continue
+		}
+		mapUrl := tool.ResolveURL(d.result.URL, seg.Map.URI)
+		var (
+			bytes []byte
+			err   error
+		)
+		if seg.Map.Length > 0 {
+			bytes, err = d.client().GetRangeContext(d.context(), mapUrl, d.headers, seg.Map.Offset, seg.Map.Length)
+			if err == nil && uint64(len(bytes)) < seg.Map.Length {
+				return fmt.Errorf("init section %s shorter than its BYTERANGE", mapUrl)
+			}
+		} else {
+			bytes, err = d.client().GetBytesContext(d.context(), mapUrl, d.headers)
+		}
+		if err != nil {
+			return fmt.Errorf("request init section %s, %s", mapUrl, err.Error())
+		}
+		if err := ioutil.WriteFile(fPath, bytes, 0644); err != nil {
+			return fmt.Errorf("write init section %s: %s", fPath, err.Error())
+		}
 	}
 	return nil
 }
 
+// initEncryption returns the protection parameters of the tracks of an init section by track ID
+func (d *Downloader) initEncryption(m *parse.Map) (map[uint32]*tool.TrackEncryption, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if tracks, ok := d.initTracks[m]; ok {
+		return tracks, nil
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(d.tsFolder, d.initFilename(m)))
+	if err != nil {
+		return nil, fmt.Errorf("read init section %s: %s", m.URI, err.Error())
+	}
+	// ClearInitSection rewrites its input, the file keeps the original until merging
+	tracks, err := tool.ClearInitSection(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse init section %s: %s", m.URI, err.Error())
+	}
+	if d.initTracks == nil {
+		d.initTracks = make(map[*parse.Map]map[uint32]*tool.TrackEncryption)
+	}
+	d.initTracks[m] = tracks
+	return tracks, nil
+}
+
+// sampleEncrypted reports whether a segment is SAMPLE-AES encrypted with a known key
+func (d *Downloader) sampleEncrypted(seg *parse.Segment) bool {
+	method, key, _, ok := d.segmentKey(seg)
+	return ok && len(key) > 0 && (method == parse.CryptMethodSampleAES || method == parse.CryptMethodSampleAESCTR)
+}
+
 func (d *Downloader) rename(fTemp string, fPath string, segIndex int) error {
 	// if d.VideoWidth == 0 {
 	// 	videoInfo := Info(fTemp)
@@ -345,7 +598,7 @@ func (d *Downloader) rename(fTemp string, fPath string, segIndex int) error {
 		con = true
 	}
 	if con {
-		err := AddWaterMarker(d.GetFFmpeg(), fTemp, fPath, d.WaterMarker, d.WaterMarkerWidth, d.WaterMarkerHeight, d.WaterMarkerLeft)
+		err := AddWaterMarkerContext(d.context(), d.GetFFmpeg(), fTemp, fPath, d.WaterMarker, d.WaterMarkerWidth, d.WaterMarkerHeight, d.WaterMarkerLeft)
 		if err != nil {
 			fmt.Println("add water marker err ", err)
 			return err
@@ -379,8 +632,13 @@ func TimeToSecond(t string) int {
 }
 
 func Info(ffmpegPath string, filePath string) *VideoInfo {
+	return InfoContext(context.Background(), ffmpegPath, filePath)
+}
+
+// InfoContext is Info killing ffmpeg once ctx is done
+func InfoContext(ctx context.Context, ffmpegPath string, filePath string) *VideoInfo {
 	res := &VideoInfo{}
-	cmd := exec.Command(ffmpegPath, "-i", filePath)
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-i", filePath)
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
 		return res
@@ -470,6 +728,11 @@ func RegOneStr(source string, pattern string) string {
 // }
 
 func AddWaterMarker(ffmpegPath string, fTemp string, fPath string, markerPath string, width int, height int, left int) error {
+	return AddWaterMarkerContext(context.Background(), ffmpegPath, fTemp, fPath, markerPath, width, height, left)
+}
+
+// AddWaterMarkerContext is AddWaterMarker killing ffmpeg once ctx is done
+func AddWaterMarkerContext(ctx context.Context, ffmpegPath string, fTemp string, fPath string, markerPath string, width int, height int, left int) error {
 	// dir, fileName := path.Split(fPath)
 	// fileName = strings.ReplaceAll(fileName, ".ts", ".mp4")
 	// mp4Path := filepath.Join(dir, fileName)
@@ -494,7 +757,7 @@ func AddWaterMarker(ffmpegPath string, fTemp string, fPath string, markerPath st
 	// 	"superfast",
 	// 	mp4Path)
 	// brStr := strconv.Itoa(br)
-	err := Cmd(false, ffmpegPath, "-y", "-i", fTemp, "-i", markerPath, "-c:v", "libx264",
+	err := CmdContext(ctx, false, ffmpegPath, "-y", "-i", fTemp, "-i", markerPath, "-c:v", "libx264",
 		"-c:a", "copy", "-filter_complex", "[1:v] scale="+strconv.Itoa(width)+":"+strconv.Itoa(height)+" [logo];[0:v][logo]overlay=x="+strconv.Itoa(left)+":y=10",
 		"-threads", strconv.Itoa(runtime.NumCPU()), "-preset",
 		"superfast",
@@ -523,7 +786,12 @@ func mp4ToTs(ffmpegPath string, filePath string) (string, error) {
 }
 
 func Cmd(showDetail bool, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+	return CmdContext(context.Background(), showDetail, name, args...)
+}
+
+// CmdContext is Cmd killing the process once ctx is done, it then returns ctx.Err() instead of panicking
+func CmdContext(ctx context.Context, showDetail bool, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
 	// 将标准输出和标准错误输出设为nil，以避免任何输出
 	cmd.Stdout = nil
 	cmd.Stderr = nil
@@ -535,6 +803,9 @@ func Cmd(showDetail bool, name string, args ...string) error {
 	}
 	err = cmd.Wait()
 	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		panic(err)
 	}
 	return nil
@@ -568,7 +839,7 @@ func (d *Downloader) next() (segIndex int, end bool, err error) {
 	defer d.lock.Unlock()
 	if len(d.queue) == 0 {
 		err = fmt.Errorf("queue empty")
-		if d.finish == int32(d.segLen) {
+		if int(atomic.LoadInt32(&d.finish))+len(d.failed) == d.segLen && !d.recording {
 			end = true
 			return
 		}
@@ -616,7 +887,25 @@ func (d *Downloader) merge() error {
 
 	writer := bufio.NewWriter(mFile)
 	mergedCount := 0
+	var initMap *parse.Map
 	for segIndex := 0; segIndex < d.segLen; segIndex++ {
+		if err := d.context().Err(); err != nil {
+			return err
+		}
+		if m := d.result.M3u8.Segments[segIndex].Map; m != nil && m != initMap {
+			// Fragmented MP4 needs its init section ahead of the media segments
+			initMap = m
+			bytes, err := ioutil.ReadFile(filepath.Join(d.tsFolder, d.initFilename(m)))
+			if err == nil && d.sampleEncrypted(d.result.M3u8.Segments[segIndex]) {
+				// The samples were decrypted, the init section must not announce protection anymore
+				_, err = tool.ClearInitSection(bytes)
+			}
+			if err != nil {
+				fmt.Printf("read init section %s error, err is %s\n ", m.URI, err)
+			} else if _, err = writer.Write(bytes); err != nil {
+				fmt.Printf("write init section %s error, err is %s\n ", m.URI, err)
+			}
+		}
 		tsFilename := d.tsFilename(segIndex)
 		bytes, err := ioutil.ReadFile(filepath.Join(d.tsFolder, tsFilename))
 		if err != nil {
@@ -692,7 +981,12 @@ func videoMerge(ffmpegPath string, in []string, out string) {
 }
 
 func CmdArr(commandName string, params []string) error {
-	cmd := exec.Command(commandName, params...)
+	return CmdArrContext(context.Background(), commandName, params)
+}
+
+// CmdArrContext is CmdArr killing the process once ctx is done, it then returns ctx.Err()
+func CmdArrContext(ctx context.Context, commandName string, params []string) error {
+	cmd := exec.CommandContext(ctx, commandName, params...)
 	cmd.Stdout = nil
 	cmd.Stderr = nil
 	err := cmd.Start()
@@ -700,11 +994,36 @@ func CmdArr(commandName string, params []string) error {
 		return err
 	}
 	err = cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
 	return err
 }
 
+// context returns the context of StartContext, Background before the download started
+func (d *Downloader) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// client returns the client throttled by Limits, or Client through ProxyUrl if it is set, otherwise Client
+func (d *Downloader) client() *tool.Client {
+	if d.limited != nil {
+		return d.limited
+	}
+	if d.proxied != nil {
+		return d.proxied
+	}
+	if d.Client != nil {
+		return d.Client
+	}
+	return tool.ProxyClient(nil)
+}
+
 func (d *Downloader) tsURL(segIndex int) string {
-	seg := d.result.M3u8.Segments[segIndex]
+	seg := d.segment(segIndex)
 	return tool.ResolveURL(d.result.URL, seg.URI)
 }
 
@@ -712,6 +1031,10 @@ func (d *Downloader) tsFilename(ts int) string {
 	return strconv.Itoa(ts) + d.GetExt()
 }
 
+func (d *Downloader) initFilename(m *parse.Map) string {
+	return "init_" + utils.Md5([]byte(m.URI+"@"+strconv.FormatUint(m.Offset, 10))) + ".mp4"
+}
+
 func genSlice(len int) []int {
 	s := make([]int, 0)
 	for i := 0; i < len; i++ {
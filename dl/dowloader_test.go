@@ -0,0 +1,287 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+func TestStartContextCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nslow.ts\n#EXTINF:10,\nslow.ts\n#EXT-X-ENDLIST\n"))
+			return
+		}
+		// The segments never arrive, only cancelling the request ends it
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d, err := NewTaskContext(ctx, t.TempDir(), server.URL+"/index.m3u8", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := d.StartContext(ctx, 2, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, result: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("cancelled download returned after %s", elapsed)
+	}
+	if failures := d.FailedSegments(); len(failures) != 0 {
+		t.Fatalf("cancelled segments were reported as failed: %+v", failures)
+	}
+
+	_, err = parse.FromURLContext(ctx, server.URL+"/index.m3u8", nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from a cancelled playlist request, result: %v", err)
+	}
+	_, err = parse.FromReaderContext(ctx, strings.NewReader("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nindex.m3u8\n"), server.URL+"/master.m3u8", nil, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from a cancelled variant request, result: %v", err)
+	}
+}
+
+func TestStreamEncryptedSegment(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	ts := bytes.Repeat([]byte{0x47, 0x40, 0x11, 0x10}, 100<<10)
+	crypted, err := tool.AES128Encrypt(append([]byte("junk before the first packet"), ts...), key, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0x0\n" +
+				"#EXTINF:10,\nseg.ts\n#EXT-X-ENDLIST\n"))
+		case "/key":
+			_, _ = w.Write(key)
+		default:
+			_, _ = w.Write(crypted)
+		}
+	}))
+	defer server.Close()
+
+	output := t.TempDir()
+	d, err := NewTask(output, server.URL+"/index.m3u8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	if err := d.Start(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(output, d.GetMergeFilename()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, ts) {
+		t.Fatalf("wrong segment of %d bytes, expected %d bytes", len(b), len(ts))
+	}
+}
+
+func TestProxyUrlKeepsCookies(t *testing.T) {
+	ts := bytes.Repeat([]byte{0x47, 0x40, 0x11, 0x10}, 47)
+	var cookie string
+	// The server is the proxy, media.test is only reachable through it
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "media.test" {
+			http.Error(w, "not proxied", http.StatusBadGateway)
+			return
+		}
+		if c, err := r.Cookie("session"); err == nil {
+			cookie = c.Value
+		}
+		_, _ = w.Write(ts)
+	}))
+	defer proxy.Close()
+
+	jar, _ := cookiejar.New(nil)
+	media, _ := url.Parse("http://media.test/")
+	jar.SetCookies(media, []*http.Cookie{{Name: "session", Value: "secret"}})
+	client := tool.NewClient(tool.ClientOptions{Jar: jar})
+	result, err := parse.FromReader(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nseg.ts\n#EXT-X-ENDLIST\n"),
+		"http://media.test/index.m3u8", nil, nil, &parse.Options{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewTaskFromPlaylist(t.TempDir(), result, nil, &parse.Options{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ProxyUrl = proxy.URL
+	d.FFmpegPath = "ffmpeg-not-installed"
+	if err := d.Start(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cookie != "secret" {
+		t.Fatalf("wrong cookie through the proxy, expected: secret, result: %q", cookie)
+	}
+}
+
+func TestBufferSegmentDecryptError(t *testing.T) {
+	// Grouped byte ranges are buffered, 17 bytes are no whole AES blocks
+	content := bytes.Repeat([]byte{0x47}, 34)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0x0\n" +
+				"#EXTINF:10,\n#EXT-X-BYTERANGE:17@0\nseg.ts\n#EXTINF:10,\n#EXT-X-BYTERANGE:17\nseg.ts\n#EXT-X-ENDLIST\n"))
+		case "/key":
+			_, _ = w.Write([]byte("0123456789abcdef"))
+		default:
+			http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewTask(t.TempDir(), server.URL+"/index.m3u8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	_ = d.Start(1, nil)
+	failures := d.FailedSegments()
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 failed segments, result: %+v", failures)
+	}
+	for _, f := range failures {
+		if !strings.Contains(f.Err.Error(), "decryt") {
+			t.Fatalf("expected a decryption error, result: %s", f.Err.Error())
+		}
+	}
+}
+
+func TestAudioDownloadedWithVideo(t *testing.T) {
+	audioRequested := make(chan struct{})
+	var once sync.Once
+	var waited int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"en\",DEFAULT=YES,URI=\"audio.m3u8\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO=\"aud\"\nvideo.m3u8\n"))
+		case "/video.m3u8", "/audio.m3u8":
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u8")
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\n" + name + ".ts\n#EXT-X-ENDLIST\n"))
+		case "/audio.ts":
+			once.Do(func() { close(audioRequested) })
+			_, _ = w.Write([]byte{0x47})
+		default:
+			// The video segment is only served once the audio is being downloaded
+			select {
+			case <-audioRequested:
+			case <-time.After(2 * time.Second):
+				atomic.StoreInt32(&waited, 1)
+			}
+			_, _ = w.Write([]byte{0x47})
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewTask(t.TempDir(), server.URL+"/master.m3u8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.audio == nil {
+		t.Fatal("missing audio rendition")
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	// Muxing fails without ffmpeg, both renditions are downloaded before
+	_ = d.Start(2, nil)
+	if atomic.LoadInt32(&waited) != 0 {
+		t.Fatal("the audio rendition was downloaded after the video")
+	}
+}
+
+func TestAudioSharesConcurrencyAndUpload(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			_, _ = w.Write([]byte("#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"en\",DEFAULT=YES,URI=\"audio.m3u8\"\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO=\"aud\"\nvideo.m3u8\n"))
+		case "/video.m3u8", "/audio.m3u8":
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u8")
+			playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n"
+			for i := 0; i < 4; i++ {
+				playlist += "#EXTINF:10,\n" + name + strconv.Itoa(i) + ".ts\n"
+			}
+			_, _ = w.Write([]byte(playlist + "#EXT-X-ENDLIST\n"))
+		default:
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			_, _ = w.Write([]byte{0x47})
+		}
+	}))
+	defer server.Close()
+
+	output := t.TempDir()
+	d, err := NewTask(output, server.URL+"/master.m3u8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	var (
+		mu       sync.Mutex
+		uploaded []string
+	)
+	d.UploadFunc = func(fp string) {
+		mu.Lock()
+		uploaded = append(uploaded, filepath.Base(filepath.Dir(fp)))
+		mu.Unlock()
+	}
+	if err := d.Start(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Fatalf("wrong number of segment requests in flight, expected at most 2, result: %d", max)
+	}
+	sort.Strings(uploaded)
+	if expected := "ts ts ts ts ts_audio ts_audio ts_audio ts_audio"; strings.Join(uploaded, " ") != expected {
+		t.Fatalf("wrong uploaded segments, expected: %s, result: %s", expected, strings.Join(uploaded, " "))
+	}
+	for _, name := range []string{tsFolderName, audioTsFolderName} {
+		if _, err := os.Stat(filepath.Join(output, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s folder not removed after uploading: %v", name, err)
+		}
+	}
+}
+
+func TestDownloadInvalidIndex(t *testing.T) {
+	m, err := parse.Parse(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\n0.ts\n#EXT-X-ENDLIST\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Downloader{result: &parse.Result{M3u8: m}, tsFolder: t.TempDir()}
+	if err := d.download(1, nil); err == nil || !strings.Contains(err.Error(), "invalid segment index") {
+		t.Fatalf("expected an invalid segment index error, result: %v", err)
+	}
+}
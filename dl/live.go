@@ -0,0 +1,267 @@
+package dl
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+// Stop ends a live recording: the playlist is no longer reloaded,
+// segments already queued are still downloaded and merged.
+func (d *Downloader) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	if d.audio != nil {
+		d.audio.Stop()
+	}
+}
+
+func (d *Downloader) startRecording() {
+	d.lock.Lock()
+	d.recording = true
+	d.recorded = 0
+	for _, seg := range d.result.M3u8.Segments {
+		d.recorded += time.Duration(float64(seg.Duration) * float64(time.Second))
+		d.lastSeq = seg.Sequence
+	}
+	d.lock.Unlock()
+	go d.record()
+}
+
+// record reloads the media playlist as RFC 8216 section 6.3.4 prescribes and queues new segments.
+// Low-latency playlists that allow it are reloaded with blocking requests and delta updates, their
+// parts are fetched as soon as they are listed or hinted and assembled into the segment once it completes.
+func (d *Downloader) record() {
+	defer func() {
+		d.lock.Lock()
+		d.recording = false
+		d.lock.Unlock()
+	}()
+	opts := &parse.Options{}
+	if d.opts != nil {
+		o := *d.opts
+		opts = &o
+	}
+	opts.Client = d.client()
+	target := time.Duration(d.result.M3u8.TargetDuration * float64(time.Second))
+	if target <= 0 {
+		target = 10 * time.Second
+	}
+	var (
+		last  = d.result.M3u8
+		wait  = target
+		delta = false
+	)
+	if last.ServerControl != nil && last.ServerControl.CanBlockReload {
+		wait = 0
+		delta = true
+	}
+	d.fetchParts(last)
+	for {
+		if d.recordLimitReached() {
+			fmt.Println("[live] record limit reached, stop recording")
+			if d.audio != nil {
+				// MaxRecordSize counts the video bytes, the audio ends with the video
+				d.audio.Stop()
+			}
+			return
+		}
+		select {
+		case <-d.stop:
+			fmt.Println("[live] recording stopped")
+			return
+		case <-d.context().Done():
+			return
+		case <-time.After(wait):
+		}
+		result, err := parse.FromURLContext(d.context(), d.reloadURL(last, delta), d.headers, nil, opts)
+		if err != nil {
+			if d.context().Err() != nil {
+				return
+			}
+			fmt.Printf("[live] reload playlist failed: %s\n", err.Error())
+			wait = target / 2
+			delta = false
+			continue
+		}
+		// Keep resolving URIs against the playlist URL without delivery directives
+		result.URL = d.result.URL
+		m := result.M3u8
+		if m.Skip != nil && len(m.Segments) > 0 && m.Segments[0].Sequence > d.lastSequence()+1 {
+			// The delta update skipped segments that were never seen, ask for a full playlist
+			delta = false
+			wait = 0
+			continue
+		}
+		added := d.appendLive(result)
+		d.fetchParts(m)
+		if err := d.downloadInitSections(); err != nil {
+			fmt.Printf("[live] %s\n", err.Error())
+		}
+		if m.EndList {
+			fmt.Println("[live] playlist ended")
+			return
+		}
+		progressed := added > 0 || len(m.Parts) != len(last.Parts)
+		last = m
+		switch {
+		case m.ServerControl != nil && m.ServerControl.CanBlockReload:
+			// The server holds the request until the next part or segment is available
+			delta = true
+			wait = 0
+			if !progressed {
+				wait = time.Duration(m.PartTarget * float64(time.Second))
+			}
+		case added == 0:
+			// The playlist did not change, retry after one-half the target duration
+			wait = target / 2
+		default:
+			wait = target
+		}
+	}
+}
+
+// reloadURL adds the low-latency delivery directives the server supports to the playlist URL:
+// _HLS_msn/_HLS_part to block until the next segment or part exists, _HLS_skip for delta updates.
+func (d *Downloader) reloadURL(last *parse.M3u8, delta bool) string {
+	sc := last.ServerControl
+	if sc == nil {
+		return d.result.URL.String()
+	}
+	u := *d.result.URL
+	query := u.Query()
+	if sc.CanBlockReload {
+		// Parts after the last segment belong to the next, incomplete segment
+		query.Set("_HLS_msn", strconv.FormatUint(d.lastSequence()+1, 10))
+		if last.PartTarget > 0 {
+			query.Set("_HLS_part", strconv.Itoa(len(last.Parts)))
+		}
+	}
+	if delta && sc.CanSkipUntil > 0 {
+		if sc.CanSkipDateRanges {
+			query.Set("_HLS_skip", "v2")
+		} else {
+			query.Set("_HLS_skip", "YES")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (d *Downloader) lastSequence() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.lastSeq
+}
+
+func (d *Downloader) recordLimitReached() bool {
+	if d.MaxRecordSize > 0 && atomic.LoadInt64(&d.written) >= d.MaxRecordSize {
+		return true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.MaxRecordDuration > 0 && d.recorded >= d.MaxRecordDuration
+}
+
+// appendLive queues the segments of a reloaded playlist that were not seen before
+// and returns how many were added.
+func (d *Downloader) appendLive(result *parse.Result) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	segments := result.M3u8.Segments
+	if len(segments) == 0 {
+		return 0
+	}
+	first, last := segments[0].Sequence, segments[len(segments)-1].Sequence
+	restarted := last < d.lastSeq
+	if restarted {
+		// The media sequence went backwards, the stream was restarted
+		fmt.Printf("[live] media sequence reset from %d to %d\n", d.lastSeq, first)
+	} else if first > d.lastSeq+1 {
+		fmt.Printf("[live] missed segments %d to %d\n", d.lastSeq+1, first-1)
+	}
+	keyIndexes := d.mergeKeys(result)
+	added := 0
+	for _, seg := range segments {
+		if !restarted && seg.Sequence <= d.lastSeq {
+			continue
+		}
+		if added == 0 && (restarted || seg.Sequence > d.lastSeq+1) {
+			// Whatever was between the last recorded segment and this one is lost
+			seg.Discontinuity = true
+		}
+		seg.KeyIndex = keyIndexes[seg.KeyIndex]
+		d.claimParts(d.segLen, seg)
+		d.result.M3u8.Segments = append(d.result.M3u8.Segments, seg)
+		d.queue = append(d.queue, d.segLen)
+		d.segLen++
+		d.recorded += time.Duration(float64(seg.Duration) * float64(time.Second))
+		added++
+	}
+	d.lastSeq = last
+	d.result.M3u8.DiscontinuitySequence = result.M3u8.DiscontinuitySequence
+	return added
+}
+
+// mergeKeys adds the keys of a reloaded playlist to the task's keys
+// and returns the task key index for each key index of the reloaded playlist.
+func (d *Downloader) mergeKeys(result *parse.Result) map[int]int {
+	indexes := map[int]int{0: 0}
+	for idx, key := range result.M3u8.Keys {
+		found := false
+		for known, k := range d.result.M3u8.Keys {
+			if k.Method == key.Method && k.URI == key.URI && k.IV == key.IV && k.HasIV == key.HasIV {
+				indexes[idx] = known
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		known := len(d.result.M3u8.Keys) + 1
+		d.result.M3u8.Keys[known] = key
+		if k, ok := result.Keys[idx]; ok {
+			d.result.Keys[known] = k
+		}
+		indexes[idx] = known
+	}
+	return indexes
+}
+
+func (d *Downloader) segment(segIndex int) *parse.Segment {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if segIndex < 0 || segIndex >= len(d.result.M3u8.Segments) {
+		return nil
+	}
+	return d.result.M3u8.Segments[segIndex]
+}
+
+func (d *Downloader) segments() []*parse.Segment {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*parse.Segment(nil), d.result.M3u8.Segments...)
+}
+
+// segmentKey returns the encryption method, decryption key and IV of a segment
+func (d *Downloader) segmentKey(seg *parse.Segment) (method parse.CryptMethod, key []byte, iv []byte, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key, ok = d.result.Keys[seg.KeyIndex]
+	if k, exist := d.result.M3u8.Keys[seg.KeyIndex]; exist {
+		method = k.Method
+		iv = k.SegmentIV(seg)
+	}
+	return
+}
+
+func (d *Downloader) total() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.segLen
+}
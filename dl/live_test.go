@@ -0,0 +1,85 @@
+package dl
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/wellmoon/m3u8/parse"
+)
+
+func TestRecordSizeLimitStopsAudio(t *testing.T) {
+	d := &Downloader{
+		result:        &parse.Result{M3u8: &parse.M3u8{TargetDuration: 10}},
+		MaxRecordSize: 1 << 20,
+		written:       1 << 20,
+		stop:          make(chan struct{}),
+		audio:         &Downloader{stop: make(chan struct{})},
+	}
+	d.record()
+	select {
+	case <-d.audio.stop:
+	default:
+		t.Fatal("the audio recording goes on after the video reached MaxRecordSize")
+	}
+}
+
+func TestRecordAssemblesParts(t *testing.T) {
+	const header = "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-VERSION:9\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.5\n#EXT-X-PART-INF:PART-TARGET=0.5\n" +
+		"#EXTINF:2,\ns0.ts\n#EXT-X-PART:DURATION=0.5,URI=\"p1.0.ts\",INDEPENDENT=YES\n"
+	var segmentRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/live.m3u8":
+			if r.URL.Query().Get("_HLS_msn") == "" {
+				_, _ = w.Write([]byte(header + "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"p1.1.ts\"\n"))
+				return
+			}
+			// The blocking reload returns once the hinted part completed segment 1
+			_, _ = w.Write([]byte(header + "#EXT-X-PART:DURATION=0.5,URI=\"p1.1.ts\"\n#EXTINF:1,\ns1.ts\n#EXT-X-ENDLIST\n"))
+		case "/s0.ts":
+			_, _ = w.Write([]byte("\x47s0"))
+		case "/s1.ts":
+			atomic.AddInt32(&segmentRequests, 1)
+			_, _ = w.Write([]byte("\x47s1"))
+		case "/p1.0.ts":
+			_, _ = w.Write([]byte("\x47p1.0"))
+		case "/p1.1.ts":
+			_, _ = w.Write([]byte("\x47p1.1"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	d, err := NewTask(t.TempDir(), server.URL+"/live.m3u8", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Live = true
+	d.FFmpegPath = "ffmpeg-not-installed"
+	var (
+		mu       sync.Mutex
+		recorded = make(map[string]string)
+	)
+	d.UploadFunc = func(fp string) {
+		b, _ := ioutil.ReadFile(fp)
+		mu.Lock()
+		recorded[filepath.Base(fp)] = string(b)
+		mu.Unlock()
+	}
+	if err := d.Start(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if recorded["0.ts"] != "\x47s0" || recorded["1.ts"] != "\x47p1.0\x47p1.1" {
+		t.Fatalf("wrong recorded segments: %q", recorded)
+	}
+	if n := atomic.LoadInt32(&segmentRequests); n != 0 {
+		t.Fatalf("segment 1 was requested %d times instead of being assembled from its parts", n)
+	}
+}
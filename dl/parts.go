@@ -0,0 +1,122 @@
+package dl
+
+import (
+	"strconv"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+// livePart is an EXT-X-PART of a low-latency live playlist, fetched as soon as it is listed
+type livePart struct {
+	done  chan struct{}
+	bytes []byte
+	err   error
+}
+
+// failed reports whether fetching the part is over and failed
+func (p *livePart) failed() bool {
+	select {
+	case <-p.done:
+		return p.err != nil
+	default:
+		return false
+	}
+}
+
+func partID(u string, offset uint64, length uint64) string {
+	return u + "@" + strconv.FormatUint(offset, 10) + ":" + strconv.FormatUint(length, 10)
+}
+
+// fetchParts starts fetching the parts of the incomplete segment of a reloaded playlist and the part
+// its preload hint announces, which the server holds until the part is available. Parts fetched before
+// that are no longer listed were claimed by a complete segment in appendLive or are dropped.
+func (d *Downloader) fetchParts(m *parse.M3u8) {
+	type partRef struct {
+		uri            string
+		offset, length uint64
+	}
+	var refs []partRef
+	for _, p := range m.Parts {
+		if !p.Gap {
+			refs = append(refs, partRef{p.URI, p.Offset, p.Length})
+		}
+	}
+	for _, hint := range m.PreloadHints {
+		// A byte range of unknown length past the start of the resource can't be requested ahead
+		if hint.Type == "PART" && (hint.Length > 0 || hint.Offset == 0) {
+			refs = append(refs, partRef{hint.URI, hint.Offset, hint.Length})
+		}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	parts := make(map[string]*livePart, len(refs))
+	for _, ref := range refs {
+		u := tool.ResolveURL(d.result.URL, ref.uri)
+		id := partID(u, ref.offset, ref.length)
+		if p, ok := d.parts[id]; ok && !p.failed() {
+			parts[id] = p
+			continue
+		}
+		p := &livePart{done: make(chan struct{})}
+		parts[id] = p
+		go func(offset, length uint64) {
+			defer close(p.done)
+			if length > 0 {
+				p.bytes, p.err = d.client().GetRangeContext(d.context(), u, d.headers, offset, length)
+			} else {
+				p.bytes, p.err = d.client().GetBytesContext(d.context(), u, d.headers)
+			}
+		}(ref.offset, ref.length)
+	}
+	d.parts = parts
+}
+
+// claimParts hands the fetched parts of a segment that just completed over to its download,
+// nothing if one of them is missing. The caller holds d.lock.
+func (d *Downloader) claimParts(segIndex int, seg *parse.Segment) {
+	if len(seg.Parts) == 0 {
+		return
+	}
+	if k, ok := d.result.M3u8.Keys[seg.KeyIndex]; ok && k.Method == parse.CryptMethodAES {
+		// Each part is encrypted on its own, the segment can't be decrypted from them as a whole
+		return
+	}
+	claimed := make([]*livePart, 0, len(seg.Parts))
+	for _, part := range seg.Parts {
+		p, ok := d.parts[partID(tool.ResolveURL(d.result.URL, part.URI), part.Offset, part.Length)]
+		if !ok || part.Gap {
+			return
+		}
+		claimed = append(claimed, p)
+	}
+	if d.segParts == nil {
+		d.segParts = make(map[int][]*livePart)
+	}
+	d.segParts[segIndex] = claimed
+}
+
+// assembleParts returns a segment concatenated from the parts fetched while it was incomplete,
+// false if it has none or one of them failed and the segment has to be fetched on its own.
+func (d *Downloader) assembleParts(segIndex int) ([]byte, bool) {
+	d.lock.Lock()
+	parts := d.segParts[segIndex]
+	delete(d.segParts, segIndex)
+	d.lock.Unlock()
+	if parts == nil {
+		return nil, false
+	}
+	var bytes []byte
+	for _, p := range parts {
+		select {
+		case <-p.done:
+		case <-d.context().Done():
+			return nil, false
+		}
+		if p.err != nil {
+			return nil, false
+		}
+		bytes = append(bytes, p.bytes...)
+	}
+	return bytes, true
+}
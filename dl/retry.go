@@ -0,0 +1,140 @@
+package dl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/wellmoon/m3u8/tool"
+)
+
+// RetryPolicy decides how failed segment downloads are retried
+type RetryPolicy struct {
+	MaxAttempts int           // attempts per segment including the first one, at least 1
+	BaseDelay   time.Duration // delay before the first retry, doubled for every further attempt
+	MaxDelay    time.Duration // upper bound of the delay, except for a longer Retry-After
+}
+
+// DefaultRetryPolicy is used when Downloader.Retry is nil
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// Delay returns how long to wait before the given retry, 1 for the first one. The exponential backoff
+// is jittered between half and all of its value, a Retry-After header of err takes precedence if longer.
+func (p RetryPolicy) Delay(retry int, err error) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d > 0 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	var se *tool.StatusError
+	if errors.As(err, &se) && se.RetryAfter > d {
+		d = se.RetryAfter
+	}
+	return d
+}
+
+// Retriable reports whether a failed download may succeed when tried again: timeouts, reset or refused
+// connections, truncated responses and the HTTP statuses of overloaded or temporarily failing servers are, cancelled downloads and other errors are not.
+func Retriable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *tool.StatusError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case 408, 425, 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+	// Every request error is a *url.Error, only timeouts and dropped connections are worth another attempt,
+	// not e.g. certificate errors or unsupported schemes
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout() || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// SegmentFailure is a segment that could not be downloaded
+type SegmentFailure struct {
+	Index    int
+	URI      string
+	Attempts int
+	Err      error
+}
+
+func (d *Downloader) retryPolicy() RetryPolicy {
+	p := DefaultRetryPolicy
+	if d.Retry != nil {
+		p = *d.Retry
+	}
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	return p
+}
+
+// retry queues a failed segment again after the backoff delay, or records it as failed for good
+func (d *Downloader) retry(segIndex int, err error) {
+	policy := d.retryPolicy()
+	d.lock.Lock()
+	if d.attempts == nil {
+		d.attempts = make(map[int]int)
+	}
+	d.attempts[segIndex]++
+	attempts := d.attempts[segIndex]
+	if !Retriable(err) || attempts >= policy.MaxAttempts {
+		if d.failed == nil {
+			d.failed = make(map[int]*SegmentFailure)
+		}
+		d.failed[segIndex] = &SegmentFailure{Index: segIndex, URI: d.result.M3u8.Segments[segIndex].URI, Attempts: attempts, Err: err}
+		d.lock.Unlock()
+		return
+	}
+	d.lock.Unlock()
+	delay := policy.Delay(attempts, err)
+	fmt.Printf("[retry] segment %d in %s, attempt %d of %d\n", segIndex, delay.Round(time.Millisecond), attempts+1, policy.MaxAttempts)
+	time.AfterFunc(delay, func() {
+		if d.context().Err() != nil {
+			return
+		}
+		if err := d.back(segIndex); err != nil {
+			fmt.Println(err.Error())
+		}
+	})
+}
+
+// FailedSegments returns the segments that could not be downloaded after all retries, by index
+func (d *Downloader) FailedSegments() []*SegmentFailure {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	failures := make([]*SegmentFailure, 0, len(d.failed))
+	for _, f := range d.failed {
+		failures = append(failures, f)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Index < failures[j].Index
+	})
+	return failures
+}
+
+func (d *Downloader) reportFailures() {
+	failures := d.FailedSegments()
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Printf("[failed] %d segments could not be downloaded:\n", len(failures))
+	for _, f := range failures {
+		fmt.Printf("  %d %s after %d attempts: %s\n", f.Index, f.URI, f.Attempts, f.Err.Error())
+	}
+}
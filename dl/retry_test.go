@@ -0,0 +1,91 @@
+package dl
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, max := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		if d := p.Delay(retry, nil); d < max/2 || d > max {
+			t.Fatalf("delay of retry %d is %s, expected between %s and %s", retry, d, max/2, max)
+		}
+	}
+	if d := p.Delay(1, &tool.StatusError{StatusCode: 429, RetryAfter: 5 * time.Second}); d != 5*time.Second {
+		t.Fatalf("Retry-After was not honored: %s", d)
+	}
+	if !Retriable(fmt.Errorf("request x, %w", &tool.StatusError{StatusCode: 503})) ||
+		Retriable(&tool.StatusError{StatusCode: 404}) || Retriable(errors.New("decryt: x")) {
+		t.Fatal("wrong retriable errors")
+	}
+	refused := &url.Error{Op: "Get", URL: "http://x/seg.ts", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	timeout := &url.Error{Op: "Get", URL: "http://x/seg.ts", Err: context.DeadlineExceeded}
+	if !Retriable(fmt.Errorf("request x, %w", refused)) || !Retriable(timeout) || !Retriable(io.ErrUnexpectedEOF) {
+		t.Fatal("network errors are not retriable")
+	}
+	tlsErr := &url.Error{Op: "Get", URL: "https://x/seg.ts", Err: x509.UnknownAuthorityError{}}
+	_, schemeErr := tool.NewClient(tool.ClientOptions{}).GetBytes("foo://x/seg.ts", nil)
+	if schemeErr == nil || !strings.Contains(schemeErr.Error(), "unsupported protocol scheme") {
+		t.Fatalf("expected an unsupported protocol scheme error, result: %v", schemeErr)
+	}
+	if Retriable(tlsErr) || Retriable(fmt.Errorf("request x, %w", schemeErr)) {
+		t.Fatal("certificate and scheme errors are retriable")
+	}
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	var flaky int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky.ts":
+			if atomic.AddInt32(&flaky, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/missing.ts":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte{0x47})
+	}))
+	defer server.Close()
+
+	result, err := parse.FromReader(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n"+
+		"#EXTINF:10,\nok.ts\n#EXTINF:10,\nflaky.ts\n#EXTINF:10,\nmissing.ts\n#EXT-X-ENDLIST\n"),
+		server.URL+"/index.m3u8", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewTaskFromPlaylist(t.TempDir(), result, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.FFmpegPath = "ffmpeg-not-installed"
+	d.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	if err := d.Start(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	failures := d.FailedSegments()
+	if len(failures) != 1 || failures[0].URI != "missing.ts" || failures[0].Attempts != 1 {
+		t.Fatalf("wrong failures: %+v", failures)
+	}
+	if flaky != 3 {
+		t.Fatalf("wrong number of requests of the flaky segment, expected: 3, result: %d", flaky)
+	}
+}
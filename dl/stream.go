@@ -0,0 +1,173 @@
+package dl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+// streamBufferSize is the buffer a worker copies a streamed segment through
+const streamBufferSize = 32 << 10
+
+// streamable reports whether a segment can be written to disk while it is downloaded. SAMPLE-AES
+// segments are decrypted as a whole, grouped byte ranges are sliced from the bytes of their group,
+// live segments are assembled from their parts.
+func (d *Downloader) streamable(segIndex int, sf *parse.Segment) bool {
+	d.lock.Lock()
+	grouped := d.rangeGroups[segIndex] != nil || d.segParts[segIndex] != nil
+	d.lock.Unlock()
+	return !grouped && !d.sampleEncrypted(sf)
+}
+
+// streamSegment writes a segment to fTemp as it arrives: the response body goes through the AES-128
+// decryptor and the TS sync byte alignment straight to the file, so a worker holds a few buffers
+// instead of the whole segment. It returns the number of bytes written.
+func (d *Downloader) streamSegment(sf *parse.Segment, tsUrl string, fTemp string) (int64, error) {
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	if sf.Length > 0 {
+		body, err = d.client().GetRangeReaderContext(d.context(), tsUrl, d.headers, sf.Offset, sf.Length)
+	} else {
+		body, err = d.client().GetContext(d.context(), tsUrl, d.headers)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("request %s, %w", tsUrl, err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer body.Close()
+	source := &errReader{r: body}
+	var r io.Reader = source
+	if method, key, iv, ok := d.segmentKey(sf); ok && len(key) > 0 && method != parse.CryptMethodNONE {
+		if r, err = tool.NewAES128DecryptReader(r, key, iv); err != nil {
+			return 0, fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+		}
+	}
+	if sf.Map == nil {
+		// Segments with an EXT-X-MAP are fragmented MP4, not TS, leave them untouched.
+		r = tool.NewSyncByteReader(r)
+	}
+	f, err := os.Create(fTemp)
+	if err != nil {
+		return 0, fmt.Errorf("create file: %s, %s", fTemp, err.Error())
+	}
+	w := &errWriter{w: bufio.NewWriterSize(f, streamBufferSize)}
+	written, err := io.CopyBuffer(w, r, make([]byte, streamBufferSize))
+	if err == nil {
+		w.flush()
+	}
+	if cerr := f.Close(); cerr != nil && w.err == nil {
+		w.err = cerr
+	}
+	switch {
+	case source.err != nil:
+		return 0, fmt.Errorf("request %s, %w", tsUrl, source.err)
+	case w.err != nil:
+		return 0, fmt.Errorf("write to %s: %s", fTemp, w.err.Error())
+	case err != nil:
+		return 0, fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+	}
+	return written, nil
+}
+
+// bufferSegment downloads a segment into memory, decrypts and writes it to fTemp.
+// It returns the number of bytes written.
+func (d *Downloader) bufferSegment(segIndex int, sf *parse.Segment, tsUrl string, fTemp string) (int64, error) {
+	bytes, e := d.fetchSegment(segIndex, tsUrl)
+	if e != nil {
+		return 0, fmt.Errorf("request %s, %w", tsUrl, e)
+	}
+	f, err := os.Create(fTemp)
+	if err != nil {
+		return 0, fmt.Errorf("create file: %s, %s", fTemp, err.Error())
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	method, key, iv, ok := d.segmentKey(sf)
+	if ok && len(key) > 0 {
+		switch method {
+		case parse.CryptMethodSampleAES, parse.CryptMethodSampleAESCTR:
+			// Only the media samples are encrypted, the container stays as it is
+			if sf.Map != nil {
+				tracks, err := d.initEncryption(sf.Map)
+				if err == nil {
+					err = tool.DecryptFMP4Segment(bytes, tracks, key, iv)
+				}
+				if err != nil {
+					return 0, fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+				}
+			} else {
+				tempBytes, err := tool.SampleAESDecryptTS(bytes, key, iv)
+				if err != nil {
+					return 0, fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+				}
+				bytes = tempBytes
+			}
+		default:
+			tempBytes, err := tool.AES128Decrypt(bytes, key, iv, tsUrl)
+			if err != nil {
+				return 0, fmt.Errorf("decryt: %s, %s", tsUrl, err.Error())
+			}
+			bytes = tempBytes
+		}
+	}
+	// https://en.wikipedia.org/wiki/MPEG_transport_stream
+	// Some TS files do not start with SyncByte 0x47, they can not be played after merging,
+	// Need to remove the bytes before the SyncByte 0x47(71).
+	// Segments with an EXT-X-MAP are fragmented MP4, not TS, leave them untouched.
+	syncByte := uint8(71) //0x47
+	bLen := len(bytes)
+	for j := 0; j < bLen && sf.Map == nil; j++ {
+		if bytes[j] == syncByte {
+			bytes = bytes[j:]
+			break
+		}
+	}
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(bytes); err != nil {
+		return 0, fmt.Errorf("write to %s: %s", fTemp, err.Error())
+	}
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("write to %s: %s", fTemp, err.Error())
+	}
+	return int64(len(bytes)), nil
+}
+
+// errReader remembers the error of the response body, to tell failed requests from undecryptable segments
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// errWriter remembers the error of the file
+type errWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *errWriter) flush() {
+	if err := w.w.Flush(); err != nil {
+		w.err = err
+	}
+}
@@ -0,0 +1,247 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+const (
+	thumbnailFolderName  = "thumbnails"
+	thumbnailVTTFilename = "thumbnails.vtt"
+	contactSheetFilename = "thumbnails.jpg"
+	defaultThumbWidth    = 160
+	// PAT and PMT packets a TS key frame range usually lacks, taken from the start of the resource
+	tsHeaderLength = 2 * 188
+)
+
+// ThumbnailOptions controls Thumbnails, the zero value writes one thumbnail per key frame
+type ThumbnailOptions struct {
+	Interval   time.Duration // minimum media time between two thumbnails, 0 keeps every key frame
+	Width      int           // thumbnail width in pixels, the height keeps the aspect ratio, default 160
+	Columns    int           // thumbnails per row of a contact sheet, 0 writes no contact sheet
+	FFmpegPath string
+	ProxyUrl   string
+	Client     *tool.Client // sends the requests, through ProxyUrl if it is set
+}
+
+type thumbnail struct {
+	seg   *parse.Segment
+	start time.Duration
+	end   time.Duration
+}
+
+// Thumbnails fetches only the key frames of an I-frame playlist, loaded with parse.Options.IFrames,
+// and writes them as JPEG files to output/thumbnails along with a WebVTT thumbnail track
+// referencing them, or referencing regions of a contact sheet if Columns is set.
+func Thumbnails(output string, result *parse.Result, headers map[string]string, opts ThumbnailOptions) error {
+	return ThumbnailsContext(context.Background(), output, result, headers, opts)
+}
+
+// ThumbnailsContext is Thumbnails cancelled with ctx, which aborts the requests and kills ffmpeg
+func ThumbnailsContext(ctx context.Context, output string, result *parse.Result, headers map[string]string, opts ThumbnailOptions) error {
+	if !result.M3u8.IFramesOnly {
+		return fmt.Errorf("not an I-frame playlist: %s", result.URL)
+	}
+	for _, key := range result.M3u8.Keys {
+		if key.Method != "" && key.Method != parse.CryptMethodNONE {
+			return fmt.Errorf("encrypted I-frame playlists are not supported")
+		}
+	}
+	if opts.Width <= 0 {
+		opts.Width = defaultThumbWidth
+	}
+	ffmpeg := opts.FFmpegPath
+	if ffmpeg == "" {
+		ffmpeg = "ffmpeg"
+	}
+	client := opts.Client
+	if len(opts.ProxyUrl) > 0 {
+		proxyUri, err := tool.ParseProxy(opts.ProxyUrl)
+		if err != nil {
+			return err
+		}
+		if client != nil {
+			client = client.WithProxy(proxyUri)
+		} else {
+			client = tool.ProxyClient(proxyUri)
+		}
+	} else if client == nil {
+		client = tool.ProxyClient(nil)
+	}
+	folder := filepath.Join(output, thumbnailFolderName)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return fmt.Errorf("create thumbnail folder '[%s]' failed: %s", folder, err.Error())
+	}
+
+	thumbs := pickThumbnails(result.M3u8.Segments, opts.Interval)
+	if len(thumbs) == 0 {
+		return fmt.Errorf("no key frame in %s", result.URL)
+	}
+	f := &frameFetcher{ctx: ctx, result: result, headers: headers, client: client, prefixes: make(map[string][]byte)}
+	for idx, thumb := range thumbs {
+		frame, err := f.fetch(thumb.seg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		framePath := filepath.Join(folder, fmt.Sprintf("frame_%05d", idx))
+		if err := ioutil.WriteFile(framePath, frame, 0644); err != nil {
+			return err
+		}
+		err = CmdArrContext(ctx, ffmpeg, []string{"-y", "-i", framePath, "-frames:v", "1",
+			"-vf", "scale=" + strconv.Itoa(opts.Width) + ":-2", "-q:v", "3", filepath.Join(folder, thumbnailFilename(idx))})
+		_ = os.Remove(framePath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("decode key frame %s: %s", thumb.seg.URI, err.Error())
+		}
+		fmt.Printf("[thumbnail %d/%d] %s\n", idx+1, len(thumbs), thumbnailFilename(idx))
+	}
+
+	first, err := ioutil.ReadFile(filepath.Join(folder, thumbnailFilename(0)))
+	if err != nil {
+		return err
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(first))
+	if err != nil {
+		return fmt.Errorf("read thumbnail size: %s", err.Error())
+	}
+	if opts.Columns > 0 {
+		rows := (len(thumbs) + opts.Columns - 1) / opts.Columns
+		err := CmdArrContext(ctx, ffmpeg, []string{"-y", "-start_number", "0", "-i", filepath.Join(folder, "%05d.jpg"),
+			"-vf", fmt.Sprintf("tile=%dx%d", opts.Columns, rows), "-frames:v", "1", "-q:v", "3",
+			filepath.Join(output, contactSheetFilename)})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("create contact sheet: %s", err.Error())
+		}
+	}
+
+	vttPath := filepath.Join(output, thumbnailVTTFilename)
+	if err := ioutil.WriteFile(vttPath, thumbnailVTT(thumbs, opts.Columns, config.Width, config.Height), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("[output] %s\n", vttPath)
+	return nil
+}
+
+// pickThumbnails keeps the first key frame and every key frame at least interval after the last one kept,
+// each thumbnail is shown until the next one starts.
+func pickThumbnails(segments []*parse.Segment, interval time.Duration) []*thumbnail {
+	var (
+		thumbs []*thumbnail
+		start  time.Duration
+	)
+	for _, seg := range segments {
+		if !seg.Gap && (len(thumbs) == 0 || start-thumbs[len(thumbs)-1].start >= interval) {
+			if len(thumbs) > 0 {
+				thumbs[len(thumbs)-1].end = start
+			}
+			thumbs = append(thumbs, &thumbnail{seg: seg, start: start})
+		}
+		start += time.Duration(float64(seg.Duration) * float64(time.Second))
+	}
+	if len(thumbs) > 0 {
+		thumbs[len(thumbs)-1].end = start
+	}
+	return thumbs
+}
+
+// thumbnailVTT returns the WebVTT track of thumbs, referencing the thumbnail files,
+// or regions of width x height of a contact sheet of columns thumbnails per row if columns is set.
+func thumbnailVTT(thumbs []*thumbnail, columns int, width int, height int) []byte {
+	var vtt bytes.Buffer
+	vtt.WriteString("WEBVTT\n")
+	for idx, thumb := range thumbs {
+		fmt.Fprintf(&vtt, "\n%s --> %s\n", vttTimestamp(thumb.start), vttTimestamp(thumb.end))
+		if columns > 0 {
+			x, y := idx%columns*width, idx/columns*height
+			fmt.Fprintf(&vtt, "%s#xywh=%d,%d,%d,%d\n", contactSheetFilename, x, y, width, height)
+		} else {
+			fmt.Fprintf(&vtt, "%s/%s\n", thumbnailFolderName, thumbnailFilename(idx))
+		}
+	}
+	return vtt.Bytes()
+}
+
+type frameFetcher struct {
+	ctx      context.Context
+	result   *parse.Result
+	headers  map[string]string
+	client   *tool.Client
+	prefixes map[string][]byte // TS headers and init sections by URL and byte range
+}
+
+// fetch returns the byte range of a key frame, preceded by what is needed to decode it on its own
+func (f *frameFetcher) fetch(seg *parse.Segment) ([]byte, error) {
+	u := tool.ResolveURL(f.result.URL, seg.URI)
+	var (
+		prefix []byte
+		err    error
+	)
+	switch {
+	case seg.Map != nil:
+		prefix, err = f.prefix(tool.ResolveURL(f.result.URL, seg.Map.URI), seg.Map.Offset, seg.Map.Length)
+	case seg.Length > 0 && seg.Offset > 0:
+		prefix, err = f.prefix(u, 0, tsHeaderLength)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request %s, %s", u, err.Error())
+	}
+	var frame []byte
+	if seg.Length > 0 {
+		frame, err = f.client.GetRangeContext(f.ctx, u, f.headers, seg.Offset, seg.Length)
+	} else {
+		frame, err = f.client.GetBytesContext(f.ctx, u, f.headers)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request %s, %s", u, err.Error())
+	}
+	return append(append([]byte(nil), prefix...), frame...), nil
+}
+
+func (f *frameFetcher) prefix(u string, offset uint64, length uint64) ([]byte, error) {
+	id := u + "@" + strconv.FormatUint(offset, 10) + ":" + strconv.FormatUint(length, 10)
+	if b, ok := f.prefixes[id]; ok {
+		return b, nil
+	}
+	var (
+		b   []byte
+		err error
+	)
+	if length > 0 {
+		b, err = f.client.GetRangeContext(f.ctx, u, f.headers, offset, length)
+	} else {
+		b, err = f.client.GetBytesContext(f.ctx, u, f.headers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.prefixes[id] = b
+	return b, nil
+}
+
+func thumbnailFilename(idx int) string {
+	return fmt.Sprintf("%05d.jpg", idx)
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,166 @@
+package dl
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wellmoon/m3u8/parse"
+	"github.com/wellmoon/m3u8/tool"
+)
+
+func TestPickThumbnails(t *testing.T) {
+	m, err := parse.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-I-FRAMES-ONLY
+#EXTINF:2,
+0.ts
+#EXTINF:2,
+1.ts
+#EXTINF:2,
+2.ts
+#EXT-X-GAP
+#EXTINF:2,
+3.ts
+#EXTINF:2,
+4.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		interval time.Duration
+		expected string // picked segments with their start and end in seconds
+	}{
+		{0, "0.ts 0-2, 1.ts 2-4, 2.ts 4-8, 4.ts 8-10"},
+		{3 * time.Second, "0.ts 0-4, 2.ts 4-8, 4.ts 8-10"},
+		{5 * time.Second, "0.ts 0-8, 4.ts 8-10"},
+		{time.Minute, "0.ts 0-10"},
+	}
+	for _, test := range tests {
+		var picked []string
+		for _, thumb := range pickThumbnails(m.Segments, test.interval) {
+			picked = append(picked, thumb.seg.URI+" "+strings.TrimSuffix(thumb.start.String(), "s")+"-"+strings.TrimSuffix(thumb.end.String(), "s"))
+		}
+		if result := strings.Join(picked, ", "); result != test.expected {
+			t.Fatalf("wrong thumbnails every %s, expected: %s, result: %s", test.interval, test.expected, result)
+		}
+	}
+}
+
+func TestVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "00:00:00.000"},
+		{1500 * time.Millisecond, "00:00:01.500"},
+		{61*time.Second + 7*time.Millisecond, "00:01:01.007"},
+		{2*time.Hour + 3*time.Minute + 4*time.Second, "02:03:04.000"},
+		{100 * time.Hour, "100:00:00.000"},
+	}
+	for _, test := range tests {
+		if result := vttTimestamp(test.d); result != test.expected {
+			t.Fatalf("wrong timestamp of %s, expected: %s, result: %s", test.d, test.expected, result)
+		}
+	}
+}
+
+func TestThumbnailVTT(t *testing.T) {
+	var thumbs []*thumbnail
+	for i := 0; i < 5; i++ {
+		thumbs = append(thumbs, &thumbnail{start: time.Duration(i) * 2 * time.Second, end: time.Duration(i+1) * 2 * time.Second})
+	}
+	tests := []struct {
+		columns  int
+		expected []string // reference of each cue
+	}{
+		{0, []string{"thumbnails/00000.jpg", "thumbnails/00001.jpg", "thumbnails/00002.jpg", "thumbnails/00003.jpg", "thumbnails/00004.jpg"}},
+		{2, []string{"thumbnails.jpg#xywh=0,0,160,90", "thumbnails.jpg#xywh=160,0,160,90", "thumbnails.jpg#xywh=0,90,160,90",
+			"thumbnails.jpg#xywh=160,90,160,90", "thumbnails.jpg#xywh=0,180,160,90"}},
+		{5, []string{"thumbnails.jpg#xywh=0,0,160,90", "thumbnails.jpg#xywh=160,0,160,90", "thumbnails.jpg#xywh=320,0,160,90",
+			"thumbnails.jpg#xywh=480,0,160,90", "thumbnails.jpg#xywh=640,0,160,90"}},
+	}
+	for _, test := range tests {
+		expected := "WEBVTT\n"
+		for i, ref := range test.expected {
+			expected += "\n" + vttTimestamp(thumbs[i].start) + " --> " + vttTimestamp(thumbs[i].end) + "\n" + ref + "\n"
+		}
+		if result := string(thumbnailVTT(thumbs, test.columns, 160, 90)); result != expected {
+			t.Fatalf("wrong track with %d columns, expected:\n%s\nresult:\n%s", test.columns, expected, result)
+		}
+	}
+}
+
+func TestFrameFetcherByteRanges(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 200)
+	var (
+		mu     sync.Mutex
+		ranges []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.URL.Path+" "+r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "main.ts", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	m, err := parse.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-I-FRAMES-ONLY
+#EXTINF:2,
+#EXT-X-BYTERANGE:500@0
+main.ts
+#EXTINF:2,
+#EXT-X-BYTERANGE:300@900
+main.ts
+#EXTINF:2,
+#EXT-X-BYTERANGE:200@1500
+main.ts
+#EXTINF:2,
+#EXT-X-BYTERANGE:100@400
+other.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(server.URL + "/index.m3u8")
+	f := &frameFetcher{ctx: context.Background(), result: &parse.Result{URL: u, M3u8: m},
+		client: tool.ProxyClient(nil), prefixes: make(map[string][]byte)}
+	header := content[:tsHeaderLength]
+	tests := []struct {
+		prefix []byte
+		ranges []string // requests sent for the frame
+	}{
+		// A range at the start of the resource already holds the TS header
+		{nil, []string{"/main.ts bytes=0-499"}},
+		{header, []string{"/main.ts bytes=0-375", "/main.ts bytes=900-1199"}},
+		// The header of the same resource is cached
+		{header, []string{"/main.ts bytes=1500-1699"}},
+		{header, []string{"/other.ts bytes=0-375", "/other.ts bytes=400-499"}},
+	}
+	for idx, test := range tests {
+		ranges = nil
+		seg := m.Segments[idx]
+		frame, err := f.fetch(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append(append([]byte(nil), test.prefix...), content[seg.Offset:seg.Offset+seg.Length]...)
+		if !bytes.Equal(frame, expected) {
+			t.Fatalf("wrong frame %d, expected: %q, result: %q", idx, expected, frame)
+		}
+		if strings.Join(ranges, ", ") != strings.Join(test.ranges, ", ") {
+			t.Fatalf("wrong requests for frame %d, expected: %v, result: %v", idx, test.ranges, ranges)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// programDateTimeLayout is the ISO 8601 layout with millisecond precision used by RFC 8216
+const programDateTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Encode returns the playlist as HLS text
+func (m *M3u8) Encode() []byte {
+	var buf bytes.Buffer
+	_, _ = m.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the playlist as HLS text to w.
+// Everything the parser understands is written back, unrecognized tags are kept verbatim.
+func (m *M3u8) WriteTo(w io.Writer) (int64, error) {
+	e := &encoder{}
+	e.line("#EXTM3U")
+	if m.Version > 0 {
+		e.line("#EXT-X-VERSION:" + strconv.Itoa(int(m.Version)))
+	}
+	if m.IndependentSegments {
+		e.line("#EXT-X-INDEPENDENT-SEGMENTS")
+	}
+	// Variables are already substituted, define them with their values to keep the output self-contained
+	for _, def := range m.Defines {
+		name := def.Name
+		if name == "" {
+			name = def.Import + def.QueryParam
+		}
+		if v, ok := m.Variables[name]; ok {
+			e.tag("#EXT-X-DEFINE", []string{`NAME="` + name + `"`, `VALUE="` + v + `"`})
+		}
+	}
+	if m.Start != nil {
+		attrs := []string{"TIME-OFFSET=" + formatFloat(m.Start.TimeOffset)}
+		if m.Start.Precise {
+			attrs = append(attrs, "PRECISE=YES")
+		}
+		e.tag("#EXT-X-START", attrs)
+	}
+	for _, tag := range m.HeaderTags {
+		e.line(tag)
+	}
+	if m.IsMaster() {
+		m.writeMaster(e)
+	} else {
+		m.writeMedia(e)
+	}
+	for _, tag := range m.UnknownTags {
+		e.line(tag)
+	}
+	if m.EndList {
+		e.line("#EXT-X-ENDLIST")
+	}
+	n, err := w.Write(e.buf.Bytes())
+	return int64(n), err
+}
+
+func (m *M3u8) writeMaster(e *encoder) {
+	for _, sd := range m.SessionData {
+		attrs := appendQuoted(nil, "DATA-ID", sd.DataID)
+		attrs = appendQuoted(attrs, "VALUE", sd.Value)
+		attrs = appendQuoted(attrs, "URI", sd.URI)
+		if sd.Format != "" {
+			attrs = append(attrs, "FORMAT="+sd.Format)
+		}
+		attrs = appendQuoted(attrs, "LANGUAGE", sd.Language)
+		e.tag("#EXT-X-SESSION-DATA", attrs)
+	}
+	for _, key := range m.SessionKeys {
+		e.tag("#EXT-X-SESSION-KEY", keyAttributes(key))
+	}
+	for _, media := range m.Medias {
+		attrs := []string{"TYPE=" + string(media.Type)}
+		attrs = appendQuoted(attrs, "GROUP-ID", media.GroupID)
+		attrs = appendQuoted(attrs, "LANGUAGE", media.Language)
+		attrs = appendQuoted(attrs, "ASSOC-LANGUAGE", media.AssocLanguage)
+		attrs = appendQuoted(attrs, "NAME", media.Name)
+		attrs = appendYes(attrs, "DEFAULT", media.Default)
+		attrs = appendYes(attrs, "AUTOSELECT", media.Autoselect)
+		attrs = appendYes(attrs, "FORCED", media.Forced)
+		attrs = appendQuoted(attrs, "URI", media.URI)
+		attrs = appendQuoted(attrs, "INSTREAM-ID", media.InstreamID)
+		attrs = appendQuoted(attrs, "CHARACTERISTICS", media.Characteristics)
+		attrs = appendQuoted(attrs, "CHANNELS", media.Channels)
+		e.tag("#EXT-X-MEDIA", attrs)
+	}
+	for _, mp := range m.MasterPlaylist {
+		e.tag("#EXT-X-STREAM-INF", streamInfAttributes(mp))
+		e.line(mp.URI)
+	}
+	for _, mp := range m.IFrameStreams {
+		e.tag("#EXT-X-I-FRAME-STREAM-INF", appendQuoted(streamInfAttributes(mp), "URI", mp.URI))
+	}
+}
+
+func streamInfAttributes(mp *MasterPlaylist) []string {
+	var attrs []string
+	if mp.ProgramID > 0 {
+		attrs = append(attrs, "PROGRAM-ID="+strconv.FormatUint(uint64(mp.ProgramID), 10))
+	}
+	attrs = append(attrs, "BANDWIDTH="+strconv.FormatUint(uint64(mp.BandWidth), 10))
+	if mp.AverageBandwidth > 0 {
+		attrs = append(attrs, "AVERAGE-BANDWIDTH="+strconv.FormatUint(uint64(mp.AverageBandwidth), 10))
+	}
+	if mp.Resolution != "" {
+		attrs = append(attrs, "RESOLUTION="+mp.Resolution)
+	}
+	if mp.FrameRate > 0 {
+		attrs = append(attrs, "FRAME-RATE="+strconv.FormatFloat(mp.FrameRate, 'f', 3, 64))
+	}
+	attrs = appendQuoted(attrs, "CODECS", mp.Codecs)
+	attrs = appendQuoted(attrs, "AUDIO", mp.Audio)
+	attrs = appendQuoted(attrs, "VIDEO", mp.Video)
+	attrs = appendQuoted(attrs, "SUBTITLES", mp.Subtitles)
+	if mp.ClosedCaptions == "NONE" {
+		attrs = append(attrs, "CLOSED-CAPTIONS=NONE")
+	} else {
+		attrs = appendQuoted(attrs, "CLOSED-CAPTIONS", mp.ClosedCaptions)
+	}
+	return attrs
+}
+
+func (m *M3u8) writeMedia(e *encoder) {
+	// A decimal-integer, segments may not be longer than it once rounded
+	e.line("#EXT-X-TARGETDURATION:" + strconv.FormatFloat(math.Ceil(m.TargetDuration), 'f', 0, 64))
+	if sc := m.ServerControl; sc != nil {
+		var attrs []string
+		if sc.CanSkipUntil > 0 {
+			attrs = append(attrs, "CAN-SKIP-UNTIL="+formatFloat(sc.CanSkipUntil))
+		}
+		attrs = appendYes(attrs, "CAN-SKIP-DATERANGES", sc.CanSkipDateRanges)
+		if sc.HoldBack > 0 {
+			attrs = append(attrs, "HOLD-BACK="+formatFloat(sc.HoldBack))
+		}
+		if sc.PartHoldBack > 0 {
+			attrs = append(attrs, "PART-HOLD-BACK="+formatFloat(sc.PartHoldBack))
+		}
+		attrs = appendYes(attrs, "CAN-BLOCK-RELOAD", sc.CanBlockReload)
+		e.tag("#EXT-X-SERVER-CONTROL", attrs)
+	}
+	if m.PartTarget > 0 {
+		e.line("#EXT-X-PART-INF:PART-TARGET=" + formatFloat(m.PartTarget))
+	}
+	if m.MediaSequence > 0 {
+		e.line("#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatUint(m.MediaSequence, 10))
+	}
+	if m.DiscontinuitySequence > 0 {
+		e.line("#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.FormatUint(m.DiscontinuitySequence, 10))
+	}
+	if m.PlaylistType != "" {
+		e.line("#EXT-X-PLAYLIST-TYPE:" + string(m.PlaylistType))
+	}
+	if m.IFramesOnly {
+		e.line("#EXT-X-I-FRAMES-ONLY")
+	}
+	for _, dr := range m.DateRanges {
+		e.tag("#EXT-X-DATERANGE", dateRangeAttributes(dr))
+	}
+	if m.Skip != nil {
+		attrs := []string{"SKIPPED-SEGMENTS=" + strconv.FormatUint(m.Skip.SkippedSegments, 10)}
+		attrs = appendQuoted(attrs, "RECENTLY-REMOVED-DATERANGES", strings.Join(m.Skip.RecentlyRemovedDateRanges, "\t"))
+		e.tag("#EXT-X-SKIP", attrs)
+	}
+	var (
+		keyIndex int
+		extMap   *Map
+		bitrate  uint64
+	)
+	for _, seg := range m.Segments {
+		for _, tag := range seg.UnknownTags {
+			e.line(tag)
+		}
+		if seg.KeyIndex != keyIndex {
+			keyIndex = seg.KeyIndex
+			if key, ok := m.Keys[keyIndex]; ok {
+				e.tag("#EXT-X-KEY", keyAttributes(key))
+			} else {
+				e.line("#EXT-X-KEY:METHOD=NONE")
+			}
+		}
+		if seg.Map != nil && seg.Map != extMap {
+			extMap = seg.Map
+			attrs := appendQuoted(nil, "URI", extMap.URI)
+			if extMap.Length > 0 {
+				attrs = append(attrs, `BYTERANGE="`+formatByteRange(extMap.Length, extMap.Offset)+`"`)
+			}
+			e.tag("#EXT-X-MAP", attrs)
+		}
+		if seg.Discontinuity {
+			e.line("#EXT-X-DISCONTINUITY")
+		}
+		if !seg.ProgramDateTime.IsZero() {
+			e.line("#EXT-X-PROGRAM-DATE-TIME:" + seg.ProgramDateTime.Format(programDateTimeLayout))
+		}
+		if seg.Bitrate != bitrate && seg.Bitrate > 0 {
+			bitrate = seg.Bitrate
+			e.line("#EXT-X-BITRATE:" + strconv.FormatUint(bitrate, 10))
+		}
+		for _, part := range seg.Parts {
+			e.tag("#EXT-X-PART", partAttributes(part))
+		}
+		if seg.Gap {
+			e.line("#EXT-X-GAP")
+		}
+		e.line("#EXTINF:" + strconv.FormatFloat(float64(seg.Duration), 'f', -1, 32) + "," + seg.Title)
+		if seg.Length > 0 {
+			e.line("#EXT-X-BYTERANGE:" + formatByteRange(seg.Length, seg.Offset))
+		}
+		e.line(seg.URI)
+	}
+	// A key change after the last segment applies to the segments still to come
+	if last := lastKeyIndex(m.Keys); last > keyIndex {
+		e.tag("#EXT-X-KEY", keyAttributes(m.Keys[last]))
+	}
+	for _, part := range m.Parts {
+		e.tag("#EXT-X-PART", partAttributes(part))
+	}
+	for _, hint := range m.PreloadHints {
+		attrs := []string{"TYPE=" + hint.Type}
+		attrs = appendQuoted(attrs, "URI", hint.URI)
+		if hint.Offset > 0 {
+			attrs = append(attrs, "BYTERANGE-START="+strconv.FormatUint(hint.Offset, 10))
+		}
+		if hint.Length > 0 {
+			attrs = append(attrs, "BYTERANGE-LENGTH="+strconv.FormatUint(hint.Length, 10))
+		}
+		e.tag("#EXT-X-PRELOAD-HINT", attrs)
+	}
+	for _, report := range m.RenditionReports {
+		attrs := appendQuoted(nil, "URI", report.URI)
+		attrs = append(attrs, "LAST-MSN="+strconv.FormatUint(report.LastMSN, 10),
+			"LAST-PART="+strconv.FormatUint(report.LastPart, 10))
+		e.tag("#EXT-X-RENDITION-REPORT", attrs)
+	}
+}
+
+func lastKeyIndex(keys map[int]*Key) int {
+	last := 0
+	for idx := range keys {
+		if idx > last {
+			last = idx
+		}
+	}
+	return last
+}
+
+func partAttributes(part *PartialSegment) []string {
+	attrs := []string{"DURATION=" + formatFloat(part.Duration)}
+	attrs = appendQuoted(attrs, "URI", part.URI)
+	attrs = appendYes(attrs, "INDEPENDENT", part.Independent)
+	if part.Length > 0 {
+		attrs = append(attrs, `BYTERANGE="`+formatByteRange(part.Length, part.Offset)+`"`)
+	}
+	return appendYes(attrs, "GAP", part.Gap)
+}
+
+func keyAttributes(key *Key) []string {
+	method := key.Method
+	if method == "" {
+		method = CryptMethodNONE
+	}
+	attrs := []string{"METHOD=" + string(method)}
+	attrs = appendQuoted(attrs, "URI", key.URI)
+	if key.HasIV {
+		attrs = append(attrs, "IV=0x"+hex.EncodeToString(key.IV[:]))
+	}
+	attrs = appendQuoted(attrs, "KEYFORMAT", key.KeyFormat)
+	attrs = appendQuoted(attrs, "KEYFORMATVERSIONS", key.KeyFormatVersions)
+	return attrs
+}
+
+func dateRangeAttributes(dr *DateRange) []string {
+	attrs := appendQuoted(nil, "ID", dr.ID)
+	attrs = appendQuoted(attrs, "CLASS", dr.Class)
+	if !dr.StartDate.IsZero() {
+		attrs = append(attrs, `START-DATE="`+dr.StartDate.Format(time.RFC3339Nano)+`"`)
+	}
+	if !dr.EndDate.IsZero() {
+		attrs = append(attrs, `END-DATE="`+dr.EndDate.Format(time.RFC3339Nano)+`"`)
+	}
+	if dr.Duration > 0 {
+		attrs = append(attrs, "DURATION="+formatFloat(dr.Duration))
+	}
+	if dr.PlannedDuration > 0 {
+		attrs = append(attrs, "PLANNED-DURATION="+formatFloat(dr.PlannedDuration))
+	}
+	// Client attributes are quoted strings unless they look like hex or decimal values
+	names := make([]string, 0, len(dr.ClientAttributes))
+	for name := range dr.ClientAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		attrs = append(attrs, name+"="+formatClientAttribute(dr.ClientAttributes[name]))
+	}
+	if dr.SCTE35Cmd != "" {
+		attrs = append(attrs, "SCTE35-CMD="+dr.SCTE35Cmd)
+	}
+	if dr.SCTE35Out != "" {
+		attrs = append(attrs, "SCTE35-OUT="+dr.SCTE35Out)
+	}
+	if dr.SCTE35In != "" {
+		attrs = append(attrs, "SCTE35-IN="+dr.SCTE35In)
+	}
+	return appendYes(attrs, "END-ON-NEXT", dr.EndOnNext)
+}
+
+func formatClientAttribute(v string) string {
+	if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+		return v
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return v
+	}
+	return `"` + v + `"`
+}
+
+func formatByteRange(length uint64, offset uint64) string {
+	return strconv.FormatUint(length, 10) + "@" + strconv.FormatUint(offset, 10)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func appendQuoted(attrs []string, name string, value string) []string {
+	if value == "" {
+		return attrs
+	}
+	return append(attrs, name+`="`+value+`"`)
+}
+
+func appendYes(attrs []string, name string, value bool) []string {
+	if !value {
+		return attrs
+	}
+	return append(attrs, name+"=YES")
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) line(s string) {
+	e.buf.WriteString(s)
+	e.buf.WriteByte('\n')
+}
+
+func (e *encoder) tag(name string, attrs []string) {
+	e.line(name + ":" + strings.Join(attrs, ","))
+}
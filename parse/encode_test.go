@@ -0,0 +1,90 @@
+package parse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	playlists := []string{`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-DATERANGE:ID="ad-1",START-DATE="2020-01-02T21:55:44Z",PLANNED-DURATION=15,X-COM-EXAMPLE-ID="abc"
+#EXT-X-CUSTOM-TAG:FOO=BAR
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x0000000000000000000000000000000a
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-PROGRAM-DATE-TIME:2020-01-02T21:55:40.000Z
+#EXT-X-BITRATE:1200
+#EXTINF:5.005,title
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXT-X-DISCONTINUITY
+#EXT-X-GAP
+#EXTINF:6,
+main.mp4
+#EXT-X-ENDLIST
+`, `#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,FRAME-RATE=29.970,CODECS="avc1.4d401f",AUDIO="aac",CLOSED-CAPTIONS=NONE
+720.m3u8
+`}
+	for _, playlist := range playlists {
+		m, err := Parse(strings.NewReader(playlist))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := m.Encode()
+		reparsed, err := Parse(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("parse encoded playlist: %s\n%s", err, encoded)
+		}
+		if again := reparsed.Encode(); !bytes.Equal(encoded, again) {
+			t.Fatalf("encoding is not stable, first:\n%s\nsecond:\n%s", encoded, again)
+		}
+		if !strings.Contains(string(encoded), "#EXT-X-CUSTOM-TAG:FOO=BAR\n") && len(m.Segments) > 0 {
+			t.Fatalf("unknown tag was not preserved:\n%s", encoded)
+		}
+	}
+}
+
+func TestEncodeUnknownTagVerbatim(t *testing.T) {
+	m, err := Parse(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-custom:foo=bar,Vendor-Id=\"x\"\n" +
+		"#EXTINF:10,\nmain.ts\n#EXT-X-ENDLIST\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := string(m.Encode()); !strings.Contains(encoded, "#EXT-X-custom:foo=bar,Vendor-Id=\"x\"\n") {
+		t.Fatalf("unknown tag was not kept verbatim:\n%s", encoded)
+	}
+}
+
+func TestEncodeHeaderAndTrailingTags(t *testing.T) {
+	m, err := Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:5.5
+#EXT-X-VENDOR-HEADER:ID=1
+#EXTINF:5.5,
+0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="next.bin"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := m.Encode()
+	reparsed, err := Parse(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("parse encoded playlist: %s\n%s", err, encoded)
+	}
+	if !strings.Contains(string(encoded), "#EXT-X-TARGETDURATION:6\n") {
+		t.Fatalf("EXT-X-TARGETDURATION is not a decimal-integer:\n%s", encoded)
+	}
+	if len(reparsed.HeaderTags) != 1 || reparsed.HeaderTags[0] != "#EXT-X-VENDOR-HEADER:ID=1" || len(reparsed.Segments[0].UnknownTags) != 0 {
+		t.Fatalf("header tag moved to the first segment:\n%s", encoded)
+	}
+	if key := reparsed.Keys[lastKeyIndex(reparsed.Keys)]; key == nil || key.URI != "next.bin" || reparsed.Segments[0].KeyIndex != 0 {
+		t.Fatalf("key after the last segment was lost:\n%s", encoded)
+	}
+}
@@ -0,0 +1,44 @@
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotM3U8 is returned when the first line of a playlist is not #EXTM3U
+	ErrNotM3U8 = errors.New("invalid m3u8, missing #EXTM3U")
+	// ErrNoSegments is returned when a media playlist has no segment to download
+	ErrNoSegments = errors.New("can not found any TS file description")
+	// ErrUnsupportedMethod is returned for EXT-X-KEY methods that can not be decrypted
+	ErrUnsupportedMethod = errors.New("unknown or unsupported cryption method")
+)
+
+// ParseError is a malformed line of a playlist, use errors.As to get it
+// and errors.Is to compare its cause with the sentinel errors above.
+type ParseError struct {
+	Line int    // 1-based line number
+	Raw  string // the line as it appears in the playlist
+	Tag  string // tag name without '#', e.g. EXT-X-KEY, empty if the line is not a tag
+	Err  error  // cause
+}
+
+func newParseError(line int, raw string, err error) *ParseError {
+	e := &ParseError{Line: line, Raw: raw, Err: err}
+	if strings.HasPrefix(raw, "#EXT") {
+		e.Tag = tagName(raw)
+	}
+	return e
+}
+
+func (e *ParseError) Error() string {
+	if e.Tag == "" {
+		return fmt.Sprintf("%s, line: %d", e.Err.Error(), e.Line)
+	}
+	return fmt.Sprintf("invalid %s: %s, line: %d", e.Tag, e.Err.Error(), e.Line)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,259 @@
+package parse
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/wellmoon/m3u8/tool"
+)
+
+// ErrKeyUnavailable is returned by key providers when the key server refuses to deliver the key,
+// the segments of such keys are left as they are.
+var ErrKeyUnavailable = errors.New("key unavailable")
+
+// KeyProvider resolves the 16 bytes decryption key of an EXT-X-KEY,
+// playlistURL is the URL of the media playlist the key URI is relative to.
+type KeyProvider interface {
+	Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error)
+}
+
+// ContextKeyProvider is a KeyProvider whose requests can be cancelled,
+// FromURLContext calls KeyContext instead of Key on such providers.
+type ContextKeyProvider interface {
+	KeyProvider
+	KeyContext(ctx context.Context, key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error)
+}
+
+// keyContext resolves key with provider, cancelled with ctx if provider supports it
+func keyContext(ctx context.Context, provider KeyProvider, key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	if p, ok := provider.(ContextKeyProvider); ok {
+		return p.KeyContext(ctx, key, playlistURL, headers)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return provider.Key(key, playlistURL, headers)
+}
+
+// KeyProviderFunc adapts an ordinary function to the KeyProvider interface
+type KeyProviderFunc func(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error)
+
+func (f KeyProviderFunc) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	return f(key, playlistURL, headers)
+}
+
+// KeyTransform decodes a key body that does not hold the raw key bytes
+type KeyTransform func(body []byte) ([]byte, error)
+
+// Base64Key decodes a base64 encoded key body
+func Base64Key(body []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+}
+
+// HexKey decodes a hex encoded key body, with or without 0x prefix
+func HexKey(body []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(body))
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	return hex.DecodeString(s)
+}
+
+func transformKey(body []byte, transform KeyTransform) ([]byte, error) {
+	if transform == nil {
+		return body, nil
+	}
+	return transform(body)
+}
+
+// HTTPKeyProvider requests the key URI, resolved against the playlist URL, with Client or through Proxy
+type HTTPKeyProvider struct {
+	Proxy     *url.URL
+	Client    *tool.Client // nil uses the shared client of Proxy
+	Transform KeyTransform // nil keeps the response body as it is
+}
+
+func (p *HTTPKeyProvider) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	return p.KeyContext(context.Background(), key, playlistURL, headers)
+}
+
+func (p *HTTPKeyProvider) KeyContext(ctx context.Context, key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	keyURL := tool.ResolveURL(playlistURL, key.URI)
+	client := p.Client
+	if client == nil {
+		client = tool.ProxyClient(p.Proxy)
+	}
+	resp, err := client.GetContext(ctx, keyURL, headers)
+	if err != nil {
+		var se *tool.StatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusForbidden {
+			// 如果获取不到key，可能不需要解密
+			return nil, ErrKeyUnavailable
+		}
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Close()
+	body, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return nil, err
+	}
+	return transformKey(body, p.Transform)
+}
+
+// FileKeyProvider reads every key from a local file
+type FileKeyProvider struct {
+	Path      string
+	Transform KeyTransform // nil keeps the file content as it is
+}
+
+func (p *FileKeyProvider) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	body, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return transformKey(body, p.Transform)
+}
+
+// HexKeyProvider returns a provider answering every key with the hex encoded key, e.g. given on the command line
+func HexKeyProvider(hexKey string) (KeyProvider, error) {
+	k, err := HexKey([]byte(hexKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex key: %s", err.Error())
+	}
+	return KeyProviderFunc(func(*Key, *url.URL, map[string]string) ([]byte, error) {
+		return k, nil
+	}), nil
+}
+
+// DataURIKeyProvider decodes keys inlined in the playlist as RFC 2397 data: URIs
+type DataURIKeyProvider struct{}
+
+func (DataURIKeyProvider) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	if !isDataURI(key.URI) {
+		return nil, fmt.Errorf("not a data URI: %s", key.URI)
+	}
+	comma := strings.IndexByte(key.URI, ',')
+	if comma < 0 {
+		return nil, errors.New("data URI without data")
+	}
+	meta, data := key.URI[len("data:"):comma], key.URI[comma+1:]
+	if strings.HasSuffix(meta, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	s, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+func isDataURI(uri string) bool {
+	return len(uri) >= 5 && strings.EqualFold(uri[:5], "data:")
+}
+
+// KeyCache remembers the keys of another provider by resolved key URI,
+// so rotated keys shared by many segments or playlist reloads are fetched once.
+// Failures are remembered too, a key that could not be loaded is not requested again.
+type KeyCache struct {
+	provider KeyProvider
+	lock     sync.Mutex
+	keys     map[string]*cachedKey
+}
+
+// cachedKey is loaded once by the first caller, requests for other URIs do not wait for it
+type cachedKey struct {
+	done      chan struct{} // closed once key and err are set
+	key       []byte
+	err       error
+	cancelled bool // the loading caller was cancelled, the entry is no longer cached
+}
+
+// NewKeyCache returns a cache in front of provider
+func NewKeyCache(provider KeyProvider) *KeyCache {
+	return &KeyCache{provider: provider, keys: make(map[string]*cachedKey)}
+}
+
+func (c *KeyCache) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	return c.KeyContext(context.Background(), key, playlistURL, headers)
+}
+
+func (c *KeyCache) KeyContext(ctx context.Context, key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	uri := key.URI
+	if !isDataURI(uri) {
+		uri = tool.ResolveURL(playlistURL, uri)
+	}
+	for {
+		c.lock.Lock()
+		entry, loading := c.keys[uri]
+		if !loading {
+			entry = &cachedKey{done: make(chan struct{})}
+			c.keys[uri] = entry
+		}
+		c.lock.Unlock()
+		if !loading {
+			entry.key, entry.err = keyContext(ctx, c.provider, key, playlistURL, headers)
+			if entry.err != nil && ctx.Err() != nil {
+				// A cancelled request says nothing about the key, the waiting callers load it again
+				entry.cancelled = true
+				c.lock.Lock()
+				delete(c.keys, uri)
+				c.lock.Unlock()
+			}
+			close(entry.done)
+			return entry.key, entry.err
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !entry.cancelled {
+			return entry.key, entry.err
+		}
+	}
+}
+
+// DefaultKeyProvider returns the provider used when Options.KeyProvider is nil: data: URIs are decoded,
+// other URIs are requested over HTTP through proxy, and keys are cached by URI.
+func DefaultKeyProvider(proxy *url.URL) KeyProvider {
+	return DefaultKeyProviderWithTransform(proxy, nil)
+}
+
+// DefaultKeyProviderWithTransform is DefaultKeyProvider decoding the HTTP responses with transform
+func DefaultKeyProviderWithTransform(proxy *url.URL, transform KeyTransform) KeyProvider {
+	return defaultKeyProvider(&HTTPKeyProvider{Proxy: proxy, Transform: transform})
+}
+
+// DefaultKeyProviderWithClient is DefaultKeyProviderWithTransform sending the requests with client
+func DefaultKeyProviderWithClient(client *tool.Client, transform KeyTransform) KeyProvider {
+	return defaultKeyProvider(&HTTPKeyProvider{Client: client, Transform: transform})
+}
+
+func defaultKeyProvider(httpProvider *HTTPKeyProvider) KeyProvider {
+	return NewKeyCache(uriKeyProvider{http: httpProvider})
+}
+
+// uriKeyProvider decodes data: URIs and requests the other ones
+type uriKeyProvider struct {
+	http *HTTPKeyProvider
+}
+
+func (p uriKeyProvider) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	return p.KeyContext(context.Background(), key, playlistURL, headers)
+}
+
+func (p uriKeyProvider) KeyContext(ctx context.Context, key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	if isDataURI(key.URI) {
+		return DataURIKeyProvider{}.Key(key, playlistURL, headers)
+	}
+	return p.http.KeyContext(ctx, key, playlistURL, headers)
+}
@@ -0,0 +1,169 @@
+package parse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyProviders(t *testing.T) {
+	expected := []byte("0123456789abcdef")
+	playlistURL, _ := url.Parse("http://www.example.com/live/index.m3u8")
+
+	k, err := DataURIKeyProvider{}.Key(&Key{URI: "data:text/plain;base64,MDEyMzQ1Njc4OWFiY2RlZg=="}, playlistURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(k, expected) {
+		t.Fatalf("wrong data URI key, expected: %x, result: %x", expected, k)
+	}
+
+	hexProvider, err := HexKeyProvider("0x30313233343536373839616263646566")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := hexProvider.Key(&Key{}, playlistURL, nil); !bytes.Equal(k, expected) {
+		t.Fatalf("wrong hex key, expected: %x, result: %x", expected, k)
+	}
+	if k, _ := Base64Key([]byte("MDEyMzQ1Njc4OWFiY2RlZg==\n")); !bytes.Equal(k, expected) {
+		t.Fatalf("wrong base64 key, expected: %x, result: %x", expected, k)
+	}
+
+	requests := 0
+	cache := NewKeyCache(KeyProviderFunc(func(*Key, *url.URL, map[string]string) ([]byte, error) {
+		requests++
+		return expected, nil
+	}))
+	for _, uri := range []string{"key1.bin", "/live/key1.bin", "key2.bin"} {
+		if _, err := cache.Key(&Key{URI: uri}, playlistURL, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 {
+		t.Fatalf("wrong number of key requests, expected: 2, result: %d", requests)
+	}
+}
+
+func TestKeyCacheLocking(t *testing.T) {
+	playlistURL, _ := url.Parse("http://www.example.com/live/index.m3u8")
+	slow := make(chan struct{})
+	requests := make(map[string]int)
+	requested := make(chan string, 10)
+	cache := NewKeyCache(KeyProviderFunc(func(key *Key, _ *url.URL, _ map[string]string) ([]byte, error) {
+		requested <- key.URI
+		switch key.URI {
+		case "slow.bin":
+			<-slow
+			return []byte("0123456789abcdef"), nil
+		case "missing.bin":
+			return nil, errors.New("http error: status code 404")
+		}
+		return []byte("fedcba9876543210"), nil
+	}))
+	go func() {
+		_, _ = cache.Key(&Key{URI: "slow.bin"}, playlistURL, nil)
+	}()
+	requests[<-requested]++
+
+	// A slow key does not hold up the others
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.Key(&Key{URI: "fast.bin"}, playlistURL, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("key request waited for another key")
+	}
+	close(slow)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.Key(&Key{URI: "missing.bin"}, playlistURL, nil); err == nil {
+			t.Fatal("expected the error of the provider")
+		}
+	}
+	if k, err := cache.Key(&Key{URI: "slow.bin"}, playlistURL, nil); err != nil || string(k) != "0123456789abcdef" {
+		t.Fatalf("wrong slow key %q: %v", k, err)
+	}
+	close(requested)
+	for uri := range requested {
+		requests[uri]++
+	}
+	for _, uri := range []string{"slow.bin", "fast.bin", "missing.bin"} {
+		if requests[uri] != 1 {
+			t.Fatalf("key %s requested %d times, expected once", uri, requests[uri])
+		}
+	}
+}
+
+func TestHTTPKeyProviderForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+	playlistURL, _ := url.Parse(server.URL + "/index.m3u8")
+	_, err := (&HTTPKeyProvider{}).Key(&Key{URI: "key.bin"}, playlistURL, nil)
+	if !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("expected ErrKeyUnavailable, result: %v", err)
+	}
+}
+
+// contextKeyProvider is a ContextKeyProvider calling its function
+type contextKeyProvider func(ctx context.Context, key *Key) ([]byte, error)
+
+func (f contextKeyProvider) Key(key *Key, playlistURL *url.URL, headers map[string]string) ([]byte, error) {
+	return f(context.Background(), key)
+}
+
+func (f contextKeyProvider) KeyContext(ctx context.Context, key *Key, _ *url.URL, _ map[string]string) ([]byte, error) {
+	return f(ctx, key)
+}
+
+func TestKeyCacheCancelledLoad(t *testing.T) {
+	playlistURL, _ := url.Parse("http://www.example.com/live/index.m3u8")
+	started := make(chan struct{})
+	var requests int32
+	cache := NewKeyCache(contextKeyProvider(func(ctx context.Context, key *Key) ([]byte, error) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first request hangs until its caller gives up
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return []byte("0123456789abcdef"), nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.KeyContext(ctx, &Key{URI: "key.bin"}, playlistURL, nil)
+		first <- err
+	}()
+	<-started
+	waiter := make(chan error, 1)
+	go func() {
+		_, err := cache.KeyContext(context.Background(), &Key{URI: "key.bin"}, playlistURL, nil)
+		waiter <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled for the cancelled caller, result: %v", err)
+	}
+	select {
+	case err := <-waiter:
+		if err != nil {
+			t.Fatalf("a caller waiting on a cancelled load failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a caller waiting on a cancelled load did not return")
+	}
+}
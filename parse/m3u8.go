@@ -3,69 +3,248 @@ package parse
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type (
 	PlaylistType string
 	CryptMethod  string
+	MediaType    string
 )
 
 const (
 	PlaylistTypeVOD   PlaylistType = "VOD"
 	PlaylistTypeEvent PlaylistType = "EVENT"
 
-	CryptMethodAES  CryptMethod = "AES-128"
-	CryptMethodNONE CryptMethod = "NONE"
+	CryptMethodAES          CryptMethod = "AES-128"
+	CryptMethodSampleAES    CryptMethod = "SAMPLE-AES"     // TS elementary stream samples or fMP4 'cbcs'
+	CryptMethodSampleAESCTR CryptMethod = "SAMPLE-AES-CTR" // fMP4 'cenc'
+	CryptMethodNONE         CryptMethod = "NONE"
+
+	MediaTypeAudio          MediaType = "AUDIO"
+	MediaTypeVideo          MediaType = "VIDEO"
+	MediaTypeSubtitles      MediaType = "SUBTITLES"
+	MediaTypeClosedCaptions MediaType = "CLOSED-CAPTIONS"
 )
 
 // regex pattern for extracting `key=value` parameters from a line
-var linePattern = regexp.MustCompile(`([a-zA-Z-]+)=("[^"]+"|[^",]+)`)
+var linePattern = regexp.MustCompile(`([a-zA-Z0-9-]+)=("[^"]*"|[^",]+)`)
 
 type M3u8 struct {
-	Version        int8   // EXT-X-VERSION:version
-	MediaSequence  uint64 // Default 0, #EXT-X-MEDIA-SEQUENCE:sequence
-	Segments       []*Segment
-	MasterPlaylist []*MasterPlaylist
-	Keys           map[int]*Key
-	EndList        bool         // #EXT-X-ENDLIST
-	PlaylistType   PlaylistType // VOD or EVENT
-	TargetDuration float64      // #EXT-X-TARGETDURATION:duration
+	Version               int8   // EXT-X-VERSION:version
+	MediaSequence         uint64 // Default 0, #EXT-X-MEDIA-SEQUENCE:sequence
+	DiscontinuitySequence uint64 // Default 0, #EXT-X-DISCONTINUITY-SEQUENCE:sequence
+	Segments              []*Segment
+	MasterPlaylist        []*MasterPlaylist
+	IFrameStreams         []*MasterPlaylist // #EXT-X-I-FRAME-STREAM-INF, variants of I-frame playlists
+	Medias                []*Media          // #EXT-X-MEDIA, alternative renditions of a master playlist
+	Keys                  map[int]*Key
+	DateRanges            []*DateRange // #EXT-X-DATERANGE
+	Start                 *Start       // #EXT-X-START
+	EndList               bool         // #EXT-X-ENDLIST
+	IndependentSegments   bool         // #EXT-X-INDEPENDENT-SEGMENTS
+	IFramesOnly           bool         // #EXT-X-I-FRAMES-ONLY, each segment is the byte range of one key frame
+	PlaylistType          PlaylistType // VOD or EVENT
+	TargetDuration        float64      // #EXT-X-TARGETDURATION:duration
+	PartTarget            float64      // #EXT-X-PART-INF:PART-TARGET=duration
+	ServerControl         *ServerControl
+	Skip                  *Skip              // #EXT-X-SKIP, set on playlist delta updates
+	Parts                 []*PartialSegment  // Partial segments of the segment that is not complete yet
+	PreloadHints          []*PreloadHint     // #EXT-X-PRELOAD-HINT
+	RenditionReports      []*RenditionReport // #EXT-X-RENDITION-REPORT
+	HeaderTags            []string           // Unrecognized tags before any media segment tag, kept verbatim
+	UnknownTags           []string           // Unrecognized tags not followed by a segment, kept verbatim
+	SessionData           []*SessionData     // #EXT-X-SESSION-DATA
+	SessionKeys           []*Key             // #EXT-X-SESSION-KEY, keys of the media playlists announced in advance
+	Defines               []*Define          // #EXT-X-DEFINE
+	// Variables are the values of the EXT-X-DEFINE variables, already substituted in the playlist
+	Variables map[string]string
+
+	tagLines map[string]int // line of the first occurrence of each tag, for diagnostics
+	issues   []Diagnostic   // problems the parser skipped over
 }
 
 type Segment struct {
+	URI             string
+	Sequence        uint64 // Media sequence number, EXT-X-MEDIA-SEQUENCE plus the position in the playlist
+	KeyIndex        int
+	Title           string    // #EXTINF: duration,<title>
+	Duration        float32   // #EXTINF: duration,<title>
+	Length          uint64    // #EXT-X-BYTERANGE: length[@offset]
+	Offset          uint64    // #EXT-X-BYTERANGE: length[@offset]
+	Discontinuity   bool      // #EXT-X-DISCONTINUITY
+	ProgramDateTime time.Time // #EXT-X-PROGRAM-DATE-TIME:<date-time-msec>
+	Gap             bool      // #EXT-X-GAP
+	Bitrate         uint64    // #EXT-X-BITRATE:<rate>, kbps, applies until the next EXT-X-BITRATE
+	Map             *Map      // #EXT-X-MAP, shared by all segments until the next EXT-X-MAP
+	Parts           []*PartialSegment
+	UnknownTags     []string // Unrecognized tags preceding the segment, kept verbatim
+	Line            int      // Line of #EXTINF in the playlist
+}
+
+// #EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+type Map struct {
+	URI    string
+	Length uint64
+	Offset uint64
+}
+
+// #EXT-X-PART:DURATION=0.33334,URI="filePart271.0.mp4",INDEPENDENT=YES
+type PartialSegment struct {
+	URI         string
+	Duration    float64
+	Independent bool
+	Gap         bool
+	Length      uint64 // BYTERANGE: length[@offset]
+	Offset      uint64 // BYTERANGE: length[@offset]
+}
+
+// #EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=12.0,PART-HOLD-BACK=1.0
+type ServerControl struct {
+	CanSkipUntil      float64
+	CanSkipDateRanges bool
+	HoldBack          float64
+	PartHoldBack      float64
+	CanBlockReload    bool
+}
+
+// #EXT-X-SKIP:SKIPPED-SEGMENTS=3
+type Skip struct {
+	SkippedSegments           uint64
+	RecentlyRemovedDateRanges []string
+}
+
+// #EXT-X-PRELOAD-HINT:TYPE=PART,URI="filePart273.3.mp4"
+type PreloadHint struct {
+	Type   string // PART or MAP
+	URI    string
+	Offset uint64 // BYTERANGE-START
+	Length uint64 // BYTERANGE-LENGTH, 0 if unknown
+}
+
+// #EXT-X-RENDITION-REPORT:URI="../1M/waitForMSN.php",LAST-MSN=273,LAST-PART=2
+type RenditionReport struct {
 	URI      string
-	KeyIndex int
-	Title    string  // #EXTINF: duration,<title>
-	Duration float32 // #EXTINF: duration,<title>
-	Length   uint64  // #EXT-X-BYTERANGE: length[@offset]
-	Offset   uint64  // #EXT-X-BYTERANGE: length[@offset]
+	LastMSN  uint64
+	LastPart uint64
+}
+
+// #EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+type Start struct {
+	TimeOffset float64
+	Precise    bool
+}
+
+// #EXT-X-DATERANGE:ID="ad-1",START-DATE="2020-01-02T21:55:44Z",PLANNED-DURATION=15.0
+type DateRange struct {
+	ID               string
+	Class            string
+	StartDate        time.Time
+	EndDate          time.Time
+	Duration         float64
+	PlannedDuration  float64
+	SCTE35Cmd        string
+	SCTE35Out        string
+	SCTE35In         string
+	EndOnNext        bool
+	ClientAttributes map[string]string // X-<client-attribute>
+	Line             int
+}
+
+// #EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="This is an example",LANGUAGE="en"
+type SessionData struct {
+	DataID   string
+	Value    string // Either Value or URI is set
+	URI      string
+	Format   string // JSON or RAW, the format of the URI resource
+	Language string
+}
+
+// #EXT-X-DEFINE:NAME="token",VALUE="abc", #EXT-X-DEFINE:IMPORT="token" or #EXT-X-DEFINE:QUERYPARAM="token"
+type Define struct {
+	Name       string
+	Value      string
+	Import     string // Name of a variable imported from the master playlist
+	QueryParam string // Name of a query parameter of the playlist URL
 }
 
 // #EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=240000,RESOLUTION=416x234,CODECS="avc1.42e00a,mp4a.40.2"
 type MasterPlaylist struct {
-	URI        string
-	BandWidth  uint32
-	Resolution string
-	Codecs     string
-	ProgramID  uint32
+	URI              string
+	BandWidth        uint32
+	AverageBandwidth uint32
+	Resolution       string
+	FrameRate        float64
+	Codecs           string
+	ProgramID        uint32
+	Audio            string // AUDIO group id
+	Video            string // VIDEO group id
+	Subtitles        string // SUBTITLES group id
+	ClosedCaptions   string // CLOSED-CAPTIONS group id, or NONE
+	// Alternatives are the EXT-X-MEDIA renditions of the groups referenced above
+	Alternatives []*Media
+	Line         int
+}
+
+// #EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="en/index.m3u8"
+type Media struct {
+	Type            MediaType
+	GroupID         string
+	Language        string
+	AssocLanguage   string
+	Name            string
+	Default         bool
+	Autoselect      bool
+	Forced          bool
+	URI             string // Empty if the rendition is included in the variant stream
+	InstreamID      string
+	Characteristics string
+	Channels        string
+	Line            int
 }
 
 // #EXT-X-KEY:METHOD=AES-128,URI="key.key"
 type Key struct {
-	// 'AES-128' or 'NONE'
+	// 'AES-128', 'SAMPLE-AES', 'SAMPLE-AES-CTR' or 'NONE'
 	// If the encryption method is NONE, the URI and the IV attributes MUST NOT be present
-	Method CryptMethod
-	URI    string
-	IV     string
+	Method            CryptMethod
+	URI               string
+	IV                [16]byte // Decoded IV attribute
+	HasIV             bool     // false if the IV attribute is absent and the media sequence number is used instead
+	KeyFormat         string
+	KeyFormatVersions string
+	Line              int
+}
+
+// ParseOptions controls how forgiving the parser is, the zero value is lenient
+type ParseOptions struct {
+	// Strict rejects playlists that break RFC 8216, see Validate. Otherwise a byte order mark,
+	// blank lines before #EXTM3U, lowercase attribute names, duplicate EXTINF tags and undefined
+	// variables are accepted and reported as warnings by Validate.
+	Strict bool
+	// Imports are the variables EXT-X-DEFINE:IMPORT may refer to, those of the master playlist
+	Imports map[string]string
+	// QueryParams are the query parameters of the playlist URL for EXT-X-DEFINE:QUERYPARAM
+	QueryParams url.Values
+}
+
+// Parse reads a master or media playlist leniently, URIs are kept as they appear in the playlist
+func Parse(reader io.Reader) (*M3u8, error) {
+	return ParseWithOptions(reader, nil)
 }
 
-func parse(reader io.Reader) (*M3u8, error) {
+// ParseWithOptions is Parse with the parsing mode chosen by opts, opts may be nil
+func ParseWithOptions(reader io.Reader, opts *ParseOptions) (*M3u8, error) {
+	strict := opts != nil && opts.Strict
 	s := bufio.NewScanner(reader)
 	var lines []string
 	for s.Scan() {
@@ -76,70 +255,219 @@ func parse(reader io.Reader) (*M3u8, error) {
 		i     = 0
 		count = len(lines)
 		m3u8  = &M3u8{
-			Keys: make(map[int]*Key),
+			Keys:      make(map[int]*Key),
+			Variables: make(map[string]string),
+			tagLines:  make(map[string]int),
 		}
 		keyIndex = 0
+		bitrate  uint64
 
 		key     *Key
 		seg     *Segment
+		extMap  *Map
+		unknown []string
+		parts   []*PartialSegment
 		extInf  bool
 		extByte bool
+		// line of an EXT-X-BYTERANGE without @offset, its sub-range follows the one of the previous segment
+		implicitOffset int
+		// last EXT-X-PART, a BYTERANGE without offset follows its sub-range
+		lastPart *PartialSegment
 	)
 
-	for ; i < count; i++ {
+	if !strict {
+		if count > 0 && strings.HasPrefix(lines[0], "\uFEFF") {
+			lines[0] = strings.TrimPrefix(lines[0], "\uFEFF")
+			m3u8.issue(SeverityWarning, 1, "EXTM3U", "4.1", "byte order mark before #EXTM3U")
+		}
+		for i < count && strings.TrimSpace(lines[i]) == "" {
+			i++
+		}
+		if i > 0 && i < count {
+			m3u8.issue(SeverityWarning, i+1, "EXTM3U", "4.3.1.1", "blank lines before #EXTM3U")
+		}
+	}
+	if i == count {
+		return nil, &ParseError{Line: i + 1, Err: ErrNotM3U8}
+	}
+	if line := strings.TrimSpace(lines[i]); "#EXTM3U" != line {
+		return nil, &ParseError{Line: i + 1, Raw: line, Err: ErrNotM3U8}
+	}
+	for i++; i < count; i++ {
 		line := strings.TrimSpace(lines[i])
-		if i == 0 {
-			if "#EXTM3U" != line {
-				return nil, fmt.Errorf("invalid m3u8, missing #EXTM3U in line 1")
+		raw := line
+		if strings.HasPrefix(line, "#EXT") {
+			name := tagName(line)
+			if m3u8.tagLines[name] == 0 {
+				m3u8.tagLines[name] = i + 1
+			}
+			if !strict && attributeListTags[name] {
+				if upper := upperAttributeNames(line); upper != line {
+					m3u8.issue(SeverityWarning, i+1, name, "4.2", "lowercase attribute names")
+					line = upper
+				}
 			}
-			continue
+		}
+		if !strings.HasPrefix(line, "#EXT-X-DEFINE:") {
+			substituted, err := m3u8.substitute(i+1, raw, line, strict)
+			if err != nil {
+				return nil, err
+			}
+			line = substituted
 		}
 		switch {
 		case line == "":
 			continue
 		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE:"):
 			if _, err := fmt.Sscanf(line, "#EXT-X-PLAYLIST-TYPE:%s", &m3u8.PlaylistType); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
 			isValid := m3u8.PlaylistType == "" || m3u8.PlaylistType == PlaylistTypeVOD || m3u8.PlaylistType == PlaylistTypeEvent
 			if !isValid {
-				return nil, fmt.Errorf("invalid playlist type: %s, line: %d", m3u8.PlaylistType, i+1)
+				return nil, newParseError(i+1, raw, fmt.Errorf("unknown type %s", m3u8.PlaylistType))
 			}
 		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
 			if _, err := fmt.Sscanf(line, "#EXT-X-TARGETDURATION:%f", &m3u8.TargetDuration); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
 		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
 			if _, err := fmt.Sscanf(line, "#EXT-X-MEDIA-SEQUENCE:%d", &m3u8.MediaSequence); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			if _, err := fmt.Sscanf(line, "#EXT-X-DISCONTINUITY-SEQUENCE:%d", &m3u8.DiscontinuitySequence); err != nil {
+				return nil, newParseError(i+1, raw, err)
 			}
 		case strings.HasPrefix(line, "#EXT-X-VERSION:"):
 			if _, err := fmt.Sscanf(line, "#EXT-X-VERSION:%d", &m3u8.Version); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
+			}
+		case strings.HasPrefix(line, "#EXT-X-PART-INF:"):
+			v, err := strconv.ParseFloat(parseLineParameters(line)["PART-TARGET"], 64)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.PartTarget = v
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			part, err := parsePart(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			if br := parseLineParameters(line)["BYTERANGE"]; br != "" && !strings.Contains(br, "@") &&
+				lastPart != nil && lastPart.URI == part.URI && lastPart.Length > 0 {
+				part.Offset = lastPart.Offset + lastPart.Length
+			}
+			lastPart = part
+			parts = append(parts, part)
+		case strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"):
+			sc, err := parseServerControl(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.ServerControl = sc
+		case strings.HasPrefix(line, "#EXT-X-SKIP:"):
+			params := parseLineParameters(line)
+			skipped, err := strconv.ParseUint(params["SKIPPED-SEGMENTS"], 10, 64)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.Skip = &Skip{SkippedSegments: skipped}
+			if v := params["RECENTLY-REMOVED-DATERANGES"]; v != "" {
+				m3u8.Skip.RecentlyRemovedDateRanges = strings.Split(v, "\t")
+			}
+		case strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:"):
+			hint, err := parsePreloadHint(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.PreloadHints = append(m3u8.PreloadHints, hint)
+		case strings.HasPrefix(line, "#EXT-X-RENDITION-REPORT:"):
+			params := parseLineParameters(line)
+			report := &RenditionReport{URI: params["URI"]}
+			var err error
+			if v, ok := params["LAST-MSN"]; ok {
+				report.LastMSN, err = strconv.ParseUint(v, 10, 64)
 			}
+			if v, ok := params["LAST-PART"]; ok && err == nil {
+				report.LastPart, err = strconv.ParseUint(v, 10, 64)
+			}
+			if err == nil && report.URI == "" {
+				err = errors.New("missing URI")
+			}
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.RenditionReports = append(m3u8.RenditionReports, report)
+		case line == "#EXT-X-INDEPENDENT-SEGMENTS":
+			m3u8.IndependentSegments = true
+		case strings.HasPrefix(line, "#EXT-X-START:"):
+			start, err := parseStart(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			m3u8.Start = start
+		case strings.HasPrefix(line, "#EXT-X-DATERANGE:"):
+			dr, err := parseDateRange(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			dr.Line = i + 1
+			m3u8.DateRanges = append(m3u8.DateRanges, dr)
 		// Parse master playlist
 		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
 			mp, err := parseMasterPlaylist(line)
 			if err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
+			}
+			mp.Line = i + 1
+			if i+1 < count {
+				next := strings.TrimSpace(lines[i+1])
+				uri, err := m3u8.substitute(i+2, next, next, strict)
+				if err != nil {
+					return nil, err
+				}
+				mp.URI = uri
 			}
-			i++
-			mp.URI = lines[i]
 			if mp.URI == "" || strings.HasPrefix(mp.URI, "#") {
-				return nil, fmt.Errorf("invalid EXT-X-STREAM-INF URI, line: %d", i+1)
+				return nil, newParseError(i+1, raw, errors.New("missing URI on the next line"))
 			}
+			i++
 			m3u8.MasterPlaylist = append(m3u8.MasterPlaylist, mp)
 			continue
+		case strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:"):
+			mp, err := parseMasterPlaylist(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			mp.URI = parseLineParameters(line)["URI"]
+			if mp.URI == "" {
+				return nil, newParseError(i+1, raw, errors.New("missing URI"))
+			}
+			mp.Line = i + 1
+			m3u8.IFrameStreams = append(m3u8.IFrameStreams, mp)
+		case line == "#EXT-X-I-FRAMES-ONLY":
+			m3u8.IFramesOnly = true
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			media, err := parseMedia(line)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			media.Line = i + 1
+			m3u8.Medias = append(m3u8.Medias, media)
 		case strings.HasPrefix(line, "#EXTINF:"):
 			if extInf {
-				return nil, fmt.Errorf("duplicate EXTINF: %s, line: %d", line, i+1)
+				if strict {
+					return nil, newParseError(i+1, raw, errors.New("duplicate EXTINF"))
+				}
+				// The last EXTINF wins
+				m3u8.issue(SeverityWarning, i+1, "EXTINF", "4.3.2.1", "duplicate EXTINF for one media segment")
 			}
 			if seg == nil {
 				seg = new(Segment)
 			}
 			var s string
 			if _, err := fmt.Sscanf(line, "#EXTINF:%s", &s); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
 			if strings.Contains(s, ",") {
 				split := strings.Split(s, ",")
@@ -148,79 +476,376 @@ func parse(reader io.Reader) (*M3u8, error) {
 			}
 			df, err := strconv.ParseFloat(s, 32)
 			if err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
 			seg.Duration = float32(df)
+			seg.Line = i + 1
 			seg.KeyIndex = keyIndex
+			seg.Bitrate = bitrate
+			seg.Map = extMap
 			extInf = true
+		case line == "#EXT-X-DISCONTINUITY":
+			if seg == nil {
+				seg = new(Segment)
+			}
+			seg.Discontinuity = true
+		case line == "#EXT-X-GAP":
+			if seg == nil {
+				seg = new(Segment)
+			}
+			seg.Gap = true
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			if seg == nil {
+				seg = new(Segment)
+			}
+			t, err := parseTime(strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			seg.ProgramDateTime = t
+		case strings.HasPrefix(line, "#EXT-X-BITRATE:"):
+			if _, err := fmt.Sscanf(line, "#EXT-X-BITRATE:%d", &bitrate); err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			params := parseLineParameters(line)
+			if params["URI"] == "" {
+				return nil, newParseError(i+1, raw, errors.New("missing URI"))
+			}
+			extMap = &Map{URI: params["URI"]}
+			if br, ok := params["BYTERANGE"]; ok {
+				length, offset, err := parseByteRange(br)
+				if err != nil {
+					return nil, newParseError(i+1, raw, fmt.Errorf("BYTERANGE %s: %w", br, err))
+				}
+				extMap.Length = length
+				extMap.Offset = offset
+			}
 		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
 			if extByte {
-				return nil, fmt.Errorf("duplicate EXT-X-BYTERANGE: %s, line: %d", line, i+1)
+				return nil, newParseError(i+1, raw, errors.New("duplicate EXT-X-BYTERANGE"))
 			}
 			if seg == nil {
 				seg = new(Segment)
 			}
 			var b string
 			if _, err := fmt.Sscanf(line, "#EXT-X-BYTERANGE:%s", &b); err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
 			if b == "" {
-				return nil, fmt.Errorf("invalid EXT-X-BYTERANGE, line: %d", i+1)
+				return nil, newParseError(i+1, raw, errors.New("empty byte range"))
 			}
-			if strings.Contains(b, "@") {
-				split := strings.Split(b, "@")
-				offset, err := strconv.ParseUint(split[1], 10, 64)
-				if err != nil {
-					return nil, err
-				}
-				seg.Offset = uint64(offset)
-				b = split[0]
-			}
-			length, err := strconv.ParseUint(b, 10, 64)
+			length, offset, err := parseByteRange(b)
 			if err != nil {
-				return nil, err
+				return nil, newParseError(i+1, raw, err)
 			}
-			seg.Length = uint64(length)
+			seg.Length = length
+			seg.Offset = offset
 			extByte = true
+			implicitOffset = 0
+			if !strings.Contains(b, "@") {
+				implicitOffset = i + 1
+			}
 		// Parse segments URI
 		case !strings.HasPrefix(line, "#"):
 			if extInf {
 				if seg == nil {
-					return nil, fmt.Errorf("invalid line: %s", line)
+					return nil, newParseError(i+1, raw, errors.New("invalid line"))
 				}
 				seg.URI = line
+				if implicitOffset > 0 {
+					if prev := m3u8.lastSegment(); prev != nil && prev.URI == seg.URI && prev.Length > 0 {
+						seg.Offset = prev.Offset + prev.Length
+					} else {
+						m3u8.issue(SeverityError, implicitOffset, "EXT-X-BYTERANGE", "4.3.2.2",
+							"EXT-X-BYTERANGE without offset does not follow a sub-range of the same resource")
+					}
+				}
+				seg.UnknownTags = unknown
+				seg.Parts = parts
+				unknown = nil
+				parts = nil
 				extByte = false
+				implicitOffset = 0
 				extInf = false
 				m3u8.Segments = append(m3u8.Segments, seg)
 				seg = nil
 				continue
 			}
+			m3u8.issue(SeverityError, i+1, "EXTINF", "4.3.2.1", "media segment URI without EXTINF is ignored: "+line)
 		// Parse key
 		case strings.HasPrefix(line, "#EXT-X-KEY"):
-			params := parseLineParameters(line)
-			if len(params) == 0 {
-				return nil, fmt.Errorf("invalid EXT-X-KEY: %s, line: %d", line, i+1)
-			}
-			method := CryptMethod(params["METHOD"])
-			if method != "" && method != CryptMethodAES && method != CryptMethodNONE {
-				return nil, fmt.Errorf("invalid EXT-X-KEY method: %s, line: %d", method, i+1)
+			k, err := m3u8.parseKey(i+1, line, strict)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
 			}
 			keyIndex++
-			key = new(Key)
-			key.Method = method
-			key.URI = params["URI"]
-			key.IV = params["IV"]
+			key = k
+			key.Line = i + 1
 			m3u8.Keys[keyIndex] = key
-		case line == "#EndList":
+		case strings.HasPrefix(line, "#EXT-X-SESSION-KEY:"):
+			k, err := m3u8.parseKey(i+1, line, strict)
+			if err != nil {
+				return nil, newParseError(i+1, raw, err)
+			}
+			k.Line = i + 1
+			m3u8.SessionKeys = append(m3u8.SessionKeys, k)
+		case strings.HasPrefix(line, "#EXT-X-SESSION-DATA:"):
+			params := parseLineParameters(line)
+			sd := &SessionData{
+				DataID:   params["DATA-ID"],
+				Value:    params["VALUE"],
+				URI:      params["URI"],
+				Format:   params["FORMAT"],
+				Language: params["LANGUAGE"],
+			}
+			if sd.DataID == "" {
+				return nil, newParseError(i+1, raw, errors.New("missing DATA-ID"))
+			}
+			m3u8.SessionData = append(m3u8.SessionData, sd)
+		case strings.HasPrefix(line, "#EXT-X-DEFINE:"):
+			def, err := m3u8.define(line, opts)
+			if err != nil {
+				if strict || def == nil {
+					return nil, newParseError(i+1, raw, err)
+				}
+				m3u8.issue(SeverityWarning, i+1, "EXT-X-DEFINE", "4.3.2.3", err.Error())
+			}
+			m3u8.Defines = append(m3u8.Defines, def)
+		case line == "#EXT-X-ENDLIST":
 			m3u8.EndList = true
+		case strings.HasPrefix(line, "#EXT"):
+			// Kept as written, attribute names of vendor tags may be case-sensitive
+			if seg == nil && len(m3u8.Segments) == 0 && len(parts) == 0 && keyIndex == 0 && extMap == nil && bitrate == 0 {
+				m3u8.HeaderTags = append(m3u8.HeaderTags, raw)
+			} else {
+				unknown = append(unknown, raw)
+			}
 		default:
+			// Comment
 			continue
 		}
 	}
+	if extInf {
+		m3u8.issue(SeverityError, seg.Line, "EXTINF", "4.3.2.1", "EXTINF without media segment URI is ignored")
+	}
+	m3u8.UnknownTags = unknown
+	m3u8.Parts = parts
+	// Segments removed by a delta update still count towards the media sequence
+	var skipped uint64
+	if m3u8.Skip != nil {
+		skipped = m3u8.Skip.SkippedSegments
+	}
+	for idx, seg := range m3u8.Segments {
+		seg.Sequence = m3u8.MediaSequence + skipped + uint64(idx)
+	}
+	for _, mp := range m3u8.MasterPlaylist {
+		mp.Alternatives = m3u8.alternatives(mp)
+	}
+	for _, mp := range m3u8.IFrameStreams {
+		mp.Alternatives = m3u8.alternatives(mp)
+	}
+	if strict {
+		for _, d := range Validate(m3u8) {
+			if d.Severity != SeverityError {
+				continue
+			}
+			e := &ParseError{Line: d.Line, Tag: d.Tag, Err: errors.New(d.Message)}
+			if d.Line > 0 {
+				e.Raw = strings.TrimSpace(lines[d.Line-1])
+			}
+			return nil, e
+		}
+	}
 
 	return m3u8, nil
 }
 
+func (m *M3u8) lastSegment() *Segment {
+	if len(m.Segments) == 0 {
+		return nil
+	}
+	return m.Segments[len(m.Segments)-1]
+}
+
+// parseKey parses an EXT-X-KEY or EXT-X-SESSION-KEY, lenient mode accepts an IV without 0x prefix
+func (m *M3u8) parseKey(lineNo int, line string, strict bool) (*Key, error) {
+	params := parseLineParameters(line)
+	if len(params) == 0 {
+		return nil, errors.New("missing attributes")
+	}
+	key := &Key{
+		Method:            CryptMethod(params["METHOD"]),
+		URI:               params["URI"],
+		KeyFormat:         params["KEYFORMAT"],
+		KeyFormatVersions: params["KEYFORMATVERSIONS"],
+	}
+	switch key.Method {
+	case "", CryptMethodAES, CryptMethodSampleAES, CryptMethodSampleAESCTR, CryptMethodNONE:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, key.Method)
+	}
+	if v, ok := params["IV"]; ok {
+		iv, err := parseIV(v)
+		if errors.Is(err, errIVPrefix) && !strict {
+			if iv, err = parseIV("0x" + v); err == nil {
+				m.issue(SeverityWarning, lineNo, tagName(line), "4.3.2.4", "IV without 0x prefix")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("IV: %w", err)
+		}
+		key.IV = iv
+		key.HasIV = true
+	}
+	return key, nil
+}
+
+// define adds the variable of an EXT-X-DEFINE to m.Variables. An unknown IMPORT or QUERYPARAM
+// returns the Define with an error, a malformed tag returns no Define.
+func (m *M3u8) define(line string, opts *ParseOptions) (*Define, error) {
+	params := parseLineParameters(line)
+	def := &Define{Name: params["NAME"], Value: params["VALUE"], Import: params["IMPORT"], QueryParam: params["QUERYPARAM"]}
+	switch {
+	case def.Name != "":
+		if _, ok := params["VALUE"]; !ok {
+			return nil, errors.New("NAME without VALUE")
+		}
+		m.Variables[def.Name] = def.Value
+	case def.Import != "":
+		var imports map[string]string
+		if opts != nil {
+			imports = opts.Imports
+		}
+		v, ok := imports[def.Import]
+		if !ok {
+			return def, fmt.Errorf("IMPORT of %s, the master playlist does not define it", def.Import)
+		}
+		m.Variables[def.Import] = v
+	case def.QueryParam != "":
+		var query url.Values
+		if opts != nil {
+			query = opts.QueryParams
+		}
+		if _, ok := query[def.QueryParam]; !ok {
+			return def, fmt.Errorf("QUERYPARAM %s, the playlist URL has no such parameter", def.QueryParam)
+		}
+		m.Variables[def.QueryParam] = query.Get(def.QueryParam)
+	default:
+		return nil, errors.New("missing NAME, IMPORT or QUERYPARAM")
+	}
+	return def, nil
+}
+
+// variablePattern matches variable references, names are made of [a-zA-Z0-9_-]
+var variablePattern = regexp.MustCompile(`\{\$([a-zA-Z0-9_-]+)\}`)
+
+// substitute replaces the variable references of a line, an undefined variable is an error in strict mode.
+// raw is the line as written in the playlist, for the error.
+func (m *M3u8) substitute(lineNo int, raw, line string, strict bool) (string, error) {
+	if !strings.Contains(line, "{$") {
+		return line, nil
+	}
+	substituted, undefined := substituteVariables(line, m.Variables)
+	if undefined != "" {
+		err := fmt.Errorf("undefined variable %s", undefined)
+		if strict {
+			return "", newParseError(lineNo, raw, err)
+		}
+		m.issue(SeverityWarning, lineNo, tagName(line), "4.3.2.3", err.Error()+", left as it is")
+	}
+	return substituted, nil
+}
+
+// substituteVariables replaces the variable references of a line with their values, references
+// to undefined variables are kept and the first one is returned.
+func substituteVariables(line string, vars map[string]string) (string, string) {
+	var undefined string
+	line = variablePattern.ReplaceAllStringFunc(line, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if undefined == "" {
+			undefined = name
+		}
+		return ref
+	})
+	return line, undefined
+}
+
+// attributeListTags are the known tags whose attribute names are upper-cased in lenient mode
+var attributeListTags = map[string]bool{
+	"EXT-X-PART-INF": true, "EXT-X-PART": true, "EXT-X-SERVER-CONTROL": true, "EXT-X-SKIP": true,
+	"EXT-X-PRELOAD-HINT": true, "EXT-X-RENDITION-REPORT": true, "EXT-X-START": true, "EXT-X-DATERANGE": true,
+	"EXT-X-STREAM-INF": true, "EXT-X-I-FRAME-STREAM-INF": true, "EXT-X-MEDIA": true, "EXT-X-MAP": true,
+	"EXT-X-KEY": true, "EXT-X-SESSION-KEY": true, "EXT-X-SESSION-DATA": true, "EXT-X-DEFINE": true,
+}
+
+// upperAttributeNames upper-cases the attribute names of an attribute list, quoted values are left as they are
+func upperAttributeNames(line string) string {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return line
+	}
+	return line[:idx+1] + linePattern.ReplaceAllStringFunc(line[idx+1:], func(attr string) string {
+		eq := strings.IndexByte(attr, '=')
+		return strings.ToUpper(attr[:eq]) + attr[eq:]
+	})
+}
+
+// IsMaster reports whether the playlist is a master playlist
+func (m *M3u8) IsMaster() bool {
+	return len(m.MasterPlaylist) > 0 || len(m.IFrameStreams) > 0 || len(m.Medias) > 0
+}
+
+// MediaGroup returns the renditions of the given type and GROUP-ID
+func (m *M3u8) MediaGroup(t MediaType, groupID string) []*Media {
+	var group []*Media
+	for _, media := range m.Medias {
+		if media.Type == t && media.GroupID == groupID {
+			group = append(group, media)
+		}
+	}
+	return group
+}
+
+// DefaultMedia picks the rendition a client should play from a group:
+// the DEFAULT=YES one, then the first AUTOSELECT=YES one, then the first one.
+func (m *M3u8) DefaultMedia(t MediaType, groupID string) *Media {
+	group := m.MediaGroup(t, groupID)
+	if len(group) == 0 {
+		return nil
+	}
+	for _, media := range group {
+		if media.Default {
+			return media
+		}
+	}
+	for _, media := range group {
+		if media.Autoselect {
+			return media
+		}
+	}
+	return group[0]
+}
+
+func (m *M3u8) alternatives(mp *MasterPlaylist) []*Media {
+	var medias []*Media
+	groups := map[MediaType]string{
+		MediaTypeAudio:          mp.Audio,
+		MediaTypeVideo:          mp.Video,
+		MediaTypeSubtitles:      mp.Subtitles,
+		MediaTypeClosedCaptions: mp.ClosedCaptions,
+	}
+	for _, media := range m.Medias {
+		if id := groups[media.Type]; id != "" && id == media.GroupID {
+			medias = append(medias, media)
+		}
+	}
+	return medias
+}
+
 func parseMasterPlaylist(line string) (*MasterPlaylist, error) {
 	params := parseLineParameters(line)
 	if len(params) == 0 {
@@ -235,8 +860,20 @@ func parseMasterPlaylist(line string) (*MasterPlaylist, error) {
 				return nil, err
 			}
 			mp.BandWidth = uint32(v)
+		case k == "AVERAGE-BANDWIDTH":
+			v, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			mp.AverageBandwidth = uint32(v)
 		case k == "RESOLUTION":
 			mp.Resolution = v
+		case k == "FRAME-RATE":
+			v, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			mp.FrameRate = v
 		case k == "PROGRAM-ID":
 			v, err := strconv.ParseUint(v, 10, 32)
 			if err != nil {
@@ -245,11 +882,225 @@ func parseMasterPlaylist(line string) (*MasterPlaylist, error) {
 			mp.ProgramID = uint32(v)
 		case k == "CODECS":
 			mp.Codecs = v
+		case k == "AUDIO":
+			mp.Audio = v
+		case k == "VIDEO":
+			mp.Video = v
+		case k == "SUBTITLES":
+			mp.Subtitles = v
+		case k == "CLOSED-CAPTIONS":
+			mp.ClosedCaptions = v
 		}
 	}
 	return mp, nil
 }
 
+func parseMedia(line string) (*Media, error) {
+	params := parseLineParameters(line)
+	media := &Media{
+		Type:            MediaType(params["TYPE"]),
+		GroupID:         params["GROUP-ID"],
+		Language:        params["LANGUAGE"],
+		AssocLanguage:   params["ASSOC-LANGUAGE"],
+		Name:            params["NAME"],
+		Default:         params["DEFAULT"] == "YES",
+		Autoselect:      params["AUTOSELECT"] == "YES",
+		Forced:          params["FORCED"] == "YES",
+		URI:             params["URI"],
+		InstreamID:      params["INSTREAM-ID"],
+		Characteristics: params["CHARACTERISTICS"],
+		Channels:        params["CHANNELS"],
+	}
+	switch media.Type {
+	case MediaTypeAudio, MediaTypeVideo, MediaTypeSubtitles, MediaTypeClosedCaptions:
+	default:
+		return nil, fmt.Errorf("unknown TYPE %q", media.Type)
+	}
+	if media.GroupID == "" || media.Name == "" {
+		return nil, errors.New("missing GROUP-ID or NAME")
+	}
+	return media, nil
+}
+
+// SegmentIV returns the IV to decrypt seg with: the IV attribute if present,
+// otherwise the media sequence number of seg as a big-endian 128-bit integer (RFC 8216 section 5.2).
+func (k *Key) SegmentIV(seg *Segment) []byte {
+	if k.HasIV {
+		iv := k.IV
+		return iv[:]
+	}
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint64(iv[8:], seg.Sequence)
+	return iv
+}
+
+// errIVPrefix is returned by parseIV for an IV without its 0x prefix
+var errIVPrefix = errors.New("missing 0x prefix")
+
+// parseIV decodes a hexadecimal-sequence of up to 128 bits, `0x` prefixed
+func parseIV(s string) ([16]byte, error) {
+	var iv [16]byte
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return iv, errIVPrefix
+	}
+	s = s[2:]
+	if len(s) == 0 || len(s) > 32 {
+		return iv, errors.New("IV must be 1 to 32 hexadecimal digits")
+	}
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return iv, err
+	}
+	copy(iv[16-len(b):], b)
+	return iv, nil
+}
+
+// parseByteRange parses `length[@offset]`
+func parseByteRange(s string) (length uint64, offset uint64, err error) {
+	if strings.Contains(s, "@") {
+		split := strings.Split(s, "@")
+		if offset, err = strconv.ParseUint(split[1], 10, 64); err != nil {
+			return
+		}
+		s = split[0]
+	}
+	length, err = strconv.ParseUint(s, 10, 64)
+	return
+}
+
+// parseTime parses an ISO 8601 date, with or without a colon in the zone offset
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	if t, e := time.Parse("2006-01-02T15:04:05.999999999Z0700", s); e == nil {
+		return t, nil
+	}
+	return time.Time{}, err
+}
+
+func parsePart(line string) (*PartialSegment, error) {
+	params := parseLineParameters(line)
+	part := &PartialSegment{
+		URI:         params["URI"],
+		Independent: params["INDEPENDENT"] == "YES",
+		Gap:         params["GAP"] == "YES",
+	}
+	if part.URI == "" {
+		return nil, errors.New("missing URI")
+	}
+	var err error
+	if part.Duration, err = strconv.ParseFloat(params["DURATION"], 64); err != nil {
+		return nil, err
+	}
+	if br, ok := params["BYTERANGE"]; ok {
+		if part.Length, part.Offset, err = parseByteRange(br); err != nil {
+			return nil, err
+		}
+	}
+	return part, nil
+}
+
+func parseServerControl(line string) (*ServerControl, error) {
+	params := parseLineParameters(line)
+	sc := &ServerControl{
+		CanSkipDateRanges: params["CAN-SKIP-DATERANGES"] == "YES",
+		CanBlockReload:    params["CAN-BLOCK-RELOAD"] == "YES",
+	}
+	var err error
+	for k, v := range params {
+		switch {
+		case k == "CAN-SKIP-UNTIL":
+			sc.CanSkipUntil, err = strconv.ParseFloat(v, 64)
+		case k == "HOLD-BACK":
+			sc.HoldBack, err = strconv.ParseFloat(v, 64)
+		case k == "PART-HOLD-BACK":
+			sc.PartHoldBack, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+	}
+	return sc, nil
+}
+
+func parsePreloadHint(line string) (*PreloadHint, error) {
+	params := parseLineParameters(line)
+	hint := &PreloadHint{Type: params["TYPE"], URI: params["URI"]}
+	if hint.URI == "" || hint.Type != "PART" && hint.Type != "MAP" {
+		return nil, errors.New("missing URI or invalid TYPE")
+	}
+	var err error
+	if v, ok := params["BYTERANGE-START"]; ok {
+		if hint.Offset, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := params["BYTERANGE-LENGTH"]; ok {
+		if hint.Length, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return hint, nil
+}
+
+func parseStart(line string) (*Start, error) {
+	params := parseLineParameters(line)
+	v, ok := params["TIME-OFFSET"]
+	if !ok {
+		return nil, errors.New("missing TIME-OFFSET")
+	}
+	offset, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Start{TimeOffset: offset, Precise: params["PRECISE"] == "YES"}, nil
+}
+
+func parseDateRange(line string) (*DateRange, error) {
+	params := parseLineParameters(line)
+	dr := &DateRange{ClientAttributes: make(map[string]string)}
+	var err error
+	for k, v := range params {
+		switch {
+		case k == "ID":
+			dr.ID = v
+		case k == "CLASS":
+			dr.Class = v
+		case k == "START-DATE":
+			dr.StartDate, err = parseTime(v)
+		case k == "END-DATE":
+			dr.EndDate, err = parseTime(v)
+		case k == "DURATION":
+			dr.Duration, err = strconv.ParseFloat(v, 64)
+		case k == "PLANNED-DURATION":
+			dr.PlannedDuration, err = strconv.ParseFloat(v, 64)
+		case k == "SCTE35-CMD":
+			dr.SCTE35Cmd = v
+		case k == "SCTE35-OUT":
+			dr.SCTE35Out = v
+		case k == "SCTE35-IN":
+			dr.SCTE35In = v
+		case k == "END-ON-NEXT":
+			dr.EndOnNext = v == "YES"
+		case strings.HasPrefix(k, "X-"):
+			dr.ClientAttributes[k] = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", k, err.Error())
+		}
+	}
+	if dr.ID == "" {
+		return nil, errors.New("missing ID")
+	}
+	return dr, nil
+}
+
 // parseLineParameters extra parameters in string `line`
 func parseLineParameters(line string) map[string]string {
 	r := linePattern.FindAllStringSubmatch(line, -1)
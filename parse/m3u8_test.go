@@ -0,0 +1,343 @@
+package parse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMediaPlaylistTags(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXT-X-DATERANGE:ID="ad-1",CLASS="com.example.ad",START-DATE="2020-01-02T21:55:44.000Z",PLANNED-DURATION=15.0,SCTE35-OUT=0xFC30,X-COM-EXAMPLE-ID="abc"
+#EXT-X-PROGRAM-DATE-TIME:2020-01-02T21:55:40.000Z
+#EXT-X-BITRATE:1200
+#EXTINF:6.0,
+seg10.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-GAP
+#EXTINF:6.0,
+seg11.m4s
+#EXT-X-ENDLIST
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.EndList {
+		t.Fatalf("EXT-X-ENDLIST not parsed")
+	}
+	if m.DiscontinuitySequence != 2 || !m.IndependentSegments {
+		t.Fatalf("wrong playlist header: %+v", m)
+	}
+	if m.Start == nil || m.Start.TimeOffset != -12.5 || !m.Start.Precise {
+		t.Fatalf("wrong EXT-X-START: %+v", m.Start)
+	}
+	if len(m.Segments) != 2 {
+		t.Fatalf("wrong segment count, expected: 2, result: %d", len(m.Segments))
+	}
+	first, second := m.Segments[0], m.Segments[1]
+	if first.Map == nil || first.Map.URI != "init.mp4" || first.Map.Length != 720 || second.Map != first.Map {
+		t.Fatalf("wrong EXT-X-MAP: %+v", first.Map)
+	}
+	expected := time.Date(2020, 1, 2, 21, 55, 40, 0, time.UTC)
+	if !first.ProgramDateTime.Equal(expected) {
+		t.Fatalf("wrong program date time, expected: %s, result: %s", expected, first.ProgramDateTime)
+	}
+	if first.Bitrate != 1200 || second.Bitrate != 1200 {
+		t.Fatalf("wrong bitrate: %d, %d", first.Bitrate, second.Bitrate)
+	}
+	if first.Discontinuity || !second.Discontinuity || !second.Gap {
+		t.Fatalf("wrong discontinuity or gap flags")
+	}
+	if len(m.DateRanges) != 1 {
+		t.Fatalf("wrong date range count, expected: 1, result: %d", len(m.DateRanges))
+	}
+	dr := m.DateRanges[0]
+	if dr.ID != "ad-1" || dr.PlannedDuration != 15 || dr.SCTE35Out != "0xFC30" || dr.ClientAttributes["X-COM-EXAMPLE-ID"] != "abc" {
+		t.Fatalf("wrong date range: %+v", dr)
+	}
+}
+
+func TestParseMasterPlaylistMedia(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",AUTOSELECT=YES,URI="audio/en.m3u8",CHANNELS="2"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="de",NAME="Deutsch",DEFAULT=YES,AUTOSELECT=YES,URI="audio/de.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="en",NAME="English",URI="subs/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aac",SUBTITLES="subs"
+video/720.m3u8
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Medias) != 3 || len(m.MasterPlaylist) != 1 {
+		t.Fatalf("wrong media or variant count: %d, %d", len(m.Medias), len(m.MasterPlaylist))
+	}
+	mp := m.MasterPlaylist[0]
+	if mp.Audio != "aac" || mp.Subtitles != "subs" || len(mp.Alternatives) != 3 {
+		t.Fatalf("wrong variant groups: %+v", mp)
+	}
+	if m.Medias[0].Channels != "2" {
+		t.Fatalf("wrong CHANNELS, expected: 2, result: %s", m.Medias[0].Channels)
+	}
+	media := m.DefaultMedia(MediaTypeAudio, mp.Audio)
+	if media == nil || media.Name != "Deutsch" {
+		t.Fatalf("wrong default audio rendition: %+v", media)
+	}
+}
+
+func TestParseLowLatencyTags(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-VERSION:9
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=24.0,PART-HOLD-BACK=1.0
+#EXT-X-PART-INF:PART-TARGET=0.33334
+#EXT-X-MEDIA-SEQUENCE:266
+#EXT-X-SKIP:SKIPPED-SEGMENTS=3
+#EXT-X-PART:DURATION=0.33334,URI="filePart269.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.33334,URI="filePart269.1.mp4"
+#EXTINF:4.00008,
+fileSequence269.mp4
+#EXT-X-PART:DURATION=0.33334,URI="filePart270.0.mp4",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="filePart270.1.mp4"
+#EXT-X-RENDITION-REPORT:URI="../1M/waitForMSN.php",LAST-MSN=270,LAST-PART=0
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := m.ServerControl
+	if sc == nil || !sc.CanBlockReload || sc.CanSkipUntil != 24 || sc.PartHoldBack != 1 {
+		t.Fatalf("wrong EXT-X-SERVER-CONTROL: %+v", sc)
+	}
+	if m.PartTarget != 0.33334 || m.Skip == nil || m.Skip.SkippedSegments != 3 {
+		t.Fatalf("wrong EXT-X-PART-INF or EXT-X-SKIP")
+	}
+	if len(m.Segments) != 1 || m.Segments[0].Sequence != 269 || len(m.Segments[0].Parts) != 2 {
+		t.Fatalf("wrong segments: %+v", m.Segments)
+	}
+	if len(m.Parts) != 1 || m.Parts[0].URI != "filePart270.0.mp4" || !m.Parts[0].Independent {
+		t.Fatalf("wrong trailing parts: %+v", m.Parts)
+	}
+	if len(m.PreloadHints) != 1 || m.PreloadHints[0].Type != "PART" {
+		t.Fatalf("wrong preload hints: %+v", m.PreloadHints)
+	}
+	if len(m.RenditionReports) != 1 || m.RenditionReports[0].LastMSN != 270 {
+		t.Fatalf("wrong rendition reports: %+v", m.RenditionReports)
+	}
+}
+
+func TestKeySegmentIV(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:10,
+0.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1A2B
+#EXTINF:10,
+1.ts
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := m.Segments[0], m.Segments[1]
+	iv := m.Keys[first.KeyIndex].SegmentIV(first)
+	expected := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 7}
+	if string(iv) != string(expected) {
+		t.Fatalf("wrong media sequence IV, expected: %x, result: %x", expected, iv)
+	}
+	iv = m.Keys[second.KeyIndex].SegmentIV(second)
+	expected = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x1a, 0x2b}
+	if string(iv) != string(expected) {
+		t.Fatalf("wrong explicit IV, expected: %x, result: %x", expected, iv)
+	}
+	if _, err := Parse(strings.NewReader("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0xZZ\n")); err == nil {
+		t.Fatalf("expected an error for an invalid IV")
+	}
+	bare := "#EXTM3U\n#EXT-X-VERSION:2\n#EXT-X-TARGETDURATION:10\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0000000000000000000000000000002a\n#EXTINF:10,\n0.ts\n"
+	m, err = Parse(strings.NewReader(bare))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iv := m.Keys[m.Segments[0].KeyIndex].IV; iv[15] != 0x2a {
+		t.Fatalf("wrong IV without 0x prefix: %x", iv)
+	}
+	if diagnostics := Validate(m); len(diagnostics) != 1 || diagnostics[0].Severity != SeverityWarning {
+		t.Fatalf("expected a warning for the IV without 0x prefix, result: %v", diagnostics)
+	}
+	if _, err := ParseWithOptions(strings.NewReader(bare), &ParseOptions{Strict: true}); err == nil {
+		t.Fatalf("expected an error for an IV without 0x prefix in strict mode")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-KEY:METHOD=AES-256,URI=\"k\"\n"))
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a ParseError, result: %v", err)
+	}
+	if pe.Line != 3 || pe.Tag != "EXT-X-KEY" || pe.Raw != `#EXT-X-KEY:METHOD=AES-256,URI="k"` {
+		t.Fatalf("wrong ParseError context: %+v", pe)
+	}
+	if !errors.Is(err, ErrUnsupportedMethod) {
+		t.Fatalf("expected ErrUnsupportedMethod, result: %v", err)
+	}
+	// Raw is the line as written, before upper-casing attribute names and substituting variables
+	for _, line := range []string{`#EXT-X-KEY:method=AES-256,uri="k"`, `#EXT-X-KEY:METHOD={$method},URI="k"`} {
+		_, err := Parse(strings.NewReader("#EXTM3U\n#EXT-X-DEFINE:NAME=\"method\",VALUE=\"AES-256\"\n" + line + "\n"))
+		if !errors.As(err, &pe) || pe.Raw != line {
+			t.Fatalf("wrong raw line, expected: %s, result: %v", line, err)
+		}
+	}
+	if _, err := Parse(strings.NewReader("<html></html>\n")); !errors.Is(err, ErrNotM3U8) {
+		t.Fatalf("expected ErrNotM3U8, result: %v", err)
+	}
+	if _, err := FromReader(strings.NewReader("#EXTM3U\n#EXT-X-ENDLIST\n"), "", nil, nil, nil); !errors.Is(err, ErrNoSegments) {
+		t.Fatalf("expected ErrNoSegments, result: %v", err)
+	}
+}
+
+func TestParseLenientAndStrict(t *testing.T) {
+	playlist := "\uFEFF\r\n#EXTM3U\r\n#EXT-X-TARGETDURATION:10\r\n#EXT-X-KEY:method=AES-128,uri=\"key.bin\"\r\n" +
+		"#EXTINF:5,\r\n#EXTINF:9,\r\n0.ts\r\n#EXT-X-ENDLIST\r\n"
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 1 || m.Segments[0].Duration != 9 {
+		t.Fatalf("wrong segments: %+v", m.Segments)
+	}
+	if key := m.Keys[m.Segments[0].KeyIndex]; key == nil || key.URI != "key.bin" || key.Method != CryptMethodAES {
+		t.Fatalf("lowercase attributes were not accepted: %+v", key)
+	}
+	warnings := 0
+	for _, d := range Validate(m) {
+		if d.Severity == SeverityWarning {
+			warnings++
+		}
+	}
+	if warnings != 4 {
+		t.Fatalf("wrong number of warnings, expected: 4, result: %v", Validate(m))
+	}
+
+	_, err = ParseWithOptions(strings.NewReader(playlist), &ParseOptions{Strict: true})
+	if !errors.Is(err, ErrNotM3U8) {
+		t.Fatalf("expected ErrNotM3U8 in strict mode, result: %v", err)
+	}
+	_, err = ParseWithOptions(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:5\n#EXTINF:9,\n0.ts\n"), &ParseOptions{Strict: true})
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 3 || pe.Tag != "EXTINF" {
+		t.Fatalf("expected a ParseError on line 3 in strict mode, result: %v", err)
+	}
+}
+
+func TestParseIFrames(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,RESOLUTION=1280x720
+720.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,RESOLUTION=1280x720,URI="720_iframes.m3u8"
+`
+	m, err := Parse(strings.NewReader(master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.MasterPlaylist) != 1 || len(m.IFrameStreams) != 1 {
+		t.Fatalf("wrong variants, expected: 1 and 1, result: %d and %d", len(m.MasterPlaylist), len(m.IFrameStreams))
+	}
+	if s := m.IFrameStreams[0]; s.URI != "720_iframes.m3u8" || s.BandWidth != 86000 {
+		t.Fatalf("wrong I-frame stream: %+v", s)
+	}
+	if !strings.Contains(string(m.Encode()), `#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,RESOLUTION=1280x720,URI="720_iframes.m3u8"`) {
+		t.Fatalf("I-frame stream was not encoded:\n%s", m.Encode())
+	}
+
+	media := `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:4
+#EXT-X-I-FRAMES-ONLY
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:9400@376
+main.ts
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:7144@150400
+main.ts
+#EXT-X-ENDLIST
+`
+	if m, err = Parse(strings.NewReader(media)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.IFramesOnly || len(m.Segments) != 2 || m.Segments[1].Offset != 150400 {
+		t.Fatalf("wrong I-frame playlist: %+v", m)
+	}
+	if diagnostics := Validate(m); len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestParseByteRangeImplicitOffset(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXTINF:10,
+#EXT-X-BYTERANGE:1000@500
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:2000
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:3000
+main.ts
+#EXTINF:10,
+#EXT-X-BYTERANGE:4000
+other.ts
+#EXT-X-ENDLIST
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, offset := range []uint64{500, 1500, 3500, 0} {
+		if m.Segments[idx].Offset != offset {
+			t.Fatalf("wrong offset of segment %d, expected: %d, result: %d", idx, offset, m.Segments[idx].Offset)
+		}
+	}
+	diagnostics := Validate(m)
+	if len(diagnostics) != 1 || diagnostics[0].Line != 14 || diagnostics[0].Tag != "EXT-X-BYTERANGE" {
+		t.Fatalf("expected an error for the range of another resource, result: %v", diagnostics)
+	}
+	if _, err := ParseWithOptions(strings.NewReader(playlist), &ParseOptions{Strict: true}); err == nil {
+		t.Fatal("expected an error in strict mode")
+	}
+}
+
+func TestParsePartImplicitOffset(t *testing.T) {
+	m, err := Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-PART-INF:PART-TARGET=1
+#EXT-X-PART:DURATION=1,URI="seg1.mp4",BYTERANGE="100@0"
+#EXT-X-PART:DURATION=1,URI="seg1.mp4",BYTERANGE="200"
+#EXTINF:2,
+seg1.mp4
+#EXT-X-PART:DURATION=1,URI="seg1.mp4",BYTERANGE="300"
+#EXT-X-PART:DURATION=1,URI="seg2.mp4",BYTERANGE="400"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := append(append([]*PartialSegment(nil), m.Segments[0].Parts...), m.Parts...)
+	for idx, offset := range []uint64{0, 100, 300, 0} {
+		if parts[idx].Offset != offset {
+			t.Fatalf("wrong offset of part %d, expected: %d, result: %d", idx, offset, parts[idx].Offset)
+		}
+	}
+}
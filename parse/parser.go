@@ -1,11 +1,12 @@
 package parse
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/url"
-	"strings"
+	"os"
 
 	"github.com/wellmoon/m3u8/tool"
 )
@@ -13,75 +14,219 @@ import (
 type Result struct {
 	URL  *url.URL
 	M3u8 *M3u8
-	Keys map[int]string
+	Keys map[int][]byte // decryption keys by key index of the segments
+	// Master is the master playlist the media playlist was selected from, nil if there was none
+	Master *M3u8
+	// Variant is the EXT-X-STREAM-INF of Master that was selected
+	Variant *MasterPlaylist
+	// Audio is the default rendition of the variant's AUDIO group,
+	// nil if the audio is muxed into the variant itself
+	Audio *Result
+}
+
+// Options controls how playlists are loaded, the zero value keeps the defaults
+type Options struct {
+	// Selector picks the variant of a master playlist, nil keeps the first one
+	Selector VariantSelector
+	// KeyProvider resolves the keys of encrypted segments, nil requests them over HTTP
+	KeyProvider KeyProvider
+	// ParseOptions chooses between lenient and strict parsing of every playlist loaded
+	ParseOptions ParseOptions
+	// IFrames loads the I-frame playlist of a master playlist, picked among its
+	// EXT-X-I-FRAME-STREAM-INF by Selector, instead of a regular variant
+	IFrames bool
+	// Client sends the playlist and key requests, nil uses the shared client of the proxy
+	Client *tool.Client
+}
+
+// HTTPClient returns Client, or the shared client of proxy if it is nil
+func (o *Options) HTTPClient(proxy *url.URL) *tool.Client {
+	if o != nil && o.Client != nil {
+		return o.Client
+	}
+	return tool.ProxyClient(proxy)
 }
 
 func FromURL(link string, headers map[string]string, uri *url.URL) (*Result, error) {
+	return FromURLWithOptions(link, headers, uri, nil)
+}
+
+// FromURLWithOptions is FromURL with the loading behaviour customized by opts, opts may be nil
+func FromURLWithOptions(link string, headers map[string]string, uri *url.URL, opts *Options) (*Result, error) {
+	return FromURLContext(context.Background(), link, headers, uri, opts)
+}
+
+// FromURLContext is FromURLWithOptions cancelled with ctx: the playlist, variant and key
+// requests in flight are aborted and ctx.Err() is returned once ctx is done.
+func FromURLContext(ctx context.Context, link string, headers map[string]string, uri *url.URL, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
 	u, err := url.Parse(link)
 	if err != nil {
 		return nil, err
 	}
 	link = u.String()
-	body, err := tool.GetByProxy(link, headers, uri)
+	body, err := opts.HTTPClient(uri).GetContext(ctx, link, headers)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// A Client with a tool.ProxyPool has already tried the other proxies on 403, 428 and 429
 		return nil, fmt.Errorf("request m3u8 URL failed: %s", err.Error())
-		// if strings.Contains(err.Error(), "status code 428") && uri != nil {
-		// 	// 尝试换代理请求
-		// 	fmt.Printf("尝试切换代理请求:%s", uri)
-		// 	body, err = tool.GetByProxy(link, headers, uri)
-		// 	if err != nil {
-		// 		return nil, fmt.Errorf("request m3u8 URL failed: %s", err.Error())
-		// 	}
-		// } else {
-		// 	return nil, fmt.Errorf("request m3u8 URL failed: %s", err.Error())
-		// }
 	}
 	//noinspection GoUnhandledErrorResult
 	defer body.Close()
-	m3u8, err := parse(body)
+	return FromReaderContext(ctx, body, link, headers, uri, opts)
+}
+
+// FromFile loads a playlist saved in a local file,
+// relative URIs are resolved against baseURL which is required if there are any.
+func FromFile(path string, baseURL string) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer f.Close()
+	return FromReader(f, baseURL, nil, nil, nil)
+}
+
+// FromReader loads a playlist obtained any other way, e.g. a string captured from a browser.
+// Relative URIs are resolved against baseURL, variant and rendition playlists as well as keys
+// are requested like FromURLWithOptions does. opts may be nil.
+func FromReader(reader io.Reader, baseURL string, headers map[string]string, uri *url.URL, opts *Options) (*Result, error) {
+	return FromReaderContext(context.Background(), reader, baseURL, headers, uri, opts)
+}
+
+// FromReaderContext is FromReader cancelled with ctx like FromURLContext
+func FromReaderContext(ctx context.Context, reader io.Reader, baseURL string, headers map[string]string, uri *url.URL, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %s", err.Error())
+	}
+	parseOpts := opts.ParseOptions
+	parseOpts.QueryParams = u.Query()
+	m3u8, err := ParseWithOptions(reader, &parseOpts)
 	if err != nil {
 		return nil, err
 	}
+	if m3u8.IsMaster() {
+		// Media playlists may import the variables of the master playlist,
+		// and share the keys announced by EXT-X-SESSION-KEY
+		o := *opts
+		o.ParseOptions.Imports = m3u8.Variables
+		if o.KeyProvider == nil {
+			o.KeyProvider = defaultKeyProvider(&HTTPKeyProvider{Proxy: uri, Client: opts.Client})
+		}
+		opts = &o
+		for _, key := range m3u8.SessionKeys {
+			if fetchKey(key) {
+				// Only warms the cache, the media playlist reports failures
+				_, _ = keyContext(ctx, opts.KeyProvider, key, u, headers)
+			}
+		}
+	}
+	if opts.IFrames && m3u8.IsMaster() {
+		if len(m3u8.IFrameStreams) == 0 {
+			return nil, errors.New("master playlist has no I-frame stream")
+		}
+		selector := opts.Selector
+		if selector == nil {
+			selector = SelectFirst
+		}
+		sf := selector(m3u8.IFrameStreams)
+		if sf == nil {
+			return nil, errors.New("no I-frame stream matches the selection policy")
+		}
+		result, err := FromURLContext(ctx, tool.ResolveURL(u, sf.URI), headers, uri, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Master = m3u8
+		result.Variant = sf
+		return result, nil
+	}
 	if len(m3u8.MasterPlaylist) != 0 {
-		sf := m3u8.MasterPlaylist[0]
-		return FromURL(tool.ResolveURL(u, sf.URI), headers, uri)
+		selector := opts.Selector
+		if selector == nil {
+			selector = SelectFirst
+		}
+		sf := selector(m3u8.MasterPlaylist)
+		if sf == nil {
+			return nil, errors.New("no variant stream matches the selection policy")
+		}
+		result, err := FromURLContext(ctx, tool.ResolveURL(u, sf.URI), headers, uri, opts)
+		if err != nil {
+			return nil, err
+		}
+		result.Master = m3u8
+		result.Variant = sf
+		if sf.Audio != "" {
+			media := m3u8.DefaultMedia(MediaTypeAudio, sf.Audio)
+			if media != nil && media.URI != "" {
+				audio, err := FromURLContext(ctx, tool.ResolveURL(u, media.URI), headers, uri, opts)
+				if err != nil {
+					if ctx.Err() != nil {
+						return nil, ctx.Err()
+					}
+					return nil, fmt.Errorf("request audio rendition %s failed: %s", media.Name, err.Error())
+				}
+				result.Audio = audio
+			}
+		}
+		return result, nil
 	}
 	if len(m3u8.Segments) == 0 {
-		return nil, errors.New("can not found any TS file description")
+		return nil, ErrNoSegments
 	}
 	result := &Result{
 		URL:  u,
 		M3u8: m3u8,
-		Keys: make(map[int]string),
+		Keys: make(map[int][]byte),
+	}
+	provider := opts.KeyProvider
+	if provider == nil {
+		provider = defaultKeyProvider(&HTTPKeyProvider{Proxy: uri, Client: opts.Client})
 	}
 
 	for idx, key := range m3u8.Keys {
 		switch {
 		case key.Method == "" || key.Method == CryptMethodNONE:
 			continue
-		case key.Method == CryptMethodAES:
-			// Request URL to extract decryption key
-			keyURL := key.URI
-			keyURL = tool.ResolveURL(u, keyURL)
-			resp, err := tool.GetByProxy(keyURL, headers, uri)
+		case key.KeyFormat != "" && key.KeyFormat != "identity":
+			// DRM systems (FairPlay, Widevine, PlayReady...) deliver keys out of band
+			continue
+		case fetchKey(key):
+			keyBytes, err := keyContext(ctx, provider, key, u, headers)
 			if err != nil {
-				if strings.Contains(err.Error(), "status code 403") {
-					// 如果获取不到key，可能不需要解密
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if errors.Is(err, ErrKeyUnavailable) {
 					continue
-				} else {
-					return nil, fmt.Errorf("extract key failed: %s", err.Error())
 				}
+				return nil, fmt.Errorf("extract key failed: %s", err.Error())
 			}
-			keyByte, err := ioutil.ReadAll(resp)
-			_ = resp.Close()
-			if err != nil {
-				return nil, err
+			if len(keyBytes) != 16 {
+				return nil, fmt.Errorf("extract key failed: %s is %d bytes long, expected 16", key.URI, len(keyBytes))
 			}
-			fmt.Println("decryption key: ", string(keyByte))
-			result.Keys[idx] = string(keyByte)
+			result.Keys[idx] = keyBytes
 		default:
-			return nil, fmt.Errorf("unknown or unsupported cryption method: %s", key.Method)
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, key.Method)
 		}
 	}
 	return result, nil
 }
+
+// fetchKey reports whether the key of a supported method can be requested from its URI
+func fetchKey(key *Key) bool {
+	switch key.Method {
+	case CryptMethodAES, CryptMethodSampleAES, CryptMethodSampleAESCTR:
+		return key.KeyFormat == "" || key.KeyFormat == "identity"
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package parse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wellmoon/m3u8/tool"
+)
+
+func TestFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.m3u8")
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10,\nvideos/0.ts\n#EXT-X-ENDLIST\n"
+	if err := ioutil.WriteFile(path, []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := FromFile(path, "http://www.example.com/test/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.M3u8.Segments) != 1 {
+		t.Fatalf("wrong number of segments, expected: 1, result: %d", len(result.M3u8.Segments))
+	}
+	expected := "http://www.example.com/test/videos/0.ts"
+	if u := tool.ResolveURL(result.URL, result.M3u8.Segments[0].URI); u != expected {
+		t.Fatalf("wrong URL, expected: %s, result: %s", expected, u)
+	}
+}
+
+func TestFromURLVariables(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:8
+#EXT-X-DEFINE:NAME="path",VALUE="media"
+#EXT-X-DEFINE:QUERYPARAM="token"
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Example",LANGUAGE="en"
+#EXT-X-SESSION-KEY:METHOD=AES-128,URI="/key.bin?token={$token}"
+#EXT-X-STREAM-INF:BANDWIDTH=1280000
+{$path}/index.m3u8?token={$token}
+`)
+	})
+	mux.HandleFunc("/media/index.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `#EXTM3U
+#EXT-X-VERSION:8
+#EXT-X-DEFINE:IMPORT="token"
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="/key.bin?token={$token}"
+#EXTINF:10,
+0.ts?token={$token}
+#EXT-X-ENDLIST
+`)
+	})
+	keyRequests := 0
+	mux.HandleFunc("/key.bin", func(w http.ResponseWriter, r *http.Request) {
+		keyRequests++
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "0123456789abcdef")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	result, err := FromURL(server.URL+"/master.m3u8?token=secret", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := result.Master.SessionData; len(title) != 1 || title[0].Value != "Example" {
+		t.Fatalf("wrong session data: %+v", title)
+	}
+	if uri := result.M3u8.Segments[0].URI; uri != "0.ts?token=secret" {
+		t.Fatalf("wrong segment URI, expected: 0.ts?token=secret, result: %s", uri)
+	}
+	if expected := server.URL + "/media/index.m3u8?token=secret"; result.URL.String() != expected {
+		t.Fatalf("wrong media playlist URL, expected: %s, result: %s", expected, result.URL)
+	}
+	if len(result.Keys) != 1 || keyRequests != 1 {
+		t.Fatalf("session key was not reused, keys: %d, requests: %d", len(result.Keys), keyRequests)
+	}
+}
@@ -0,0 +1,229 @@
+package parse
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota // players usually cope, the playlist is still not compliant
+	SeverityError                   // violates a MUST of RFC 8216, playback or download may break
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found in a playlist
+type Diagnostic struct {
+	Severity Severity
+	Line     int    // 1-based line in the playlist, 0 if the problem is not tied to a line
+	Tag      string // e.g. EXTINF or EXT-X-KEY
+	Section  string // RFC 8216 section, e.g. 4.3.3.1
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	pos := "-"
+	if d.Line > 0 {
+		pos = fmt.Sprintf("line %d", d.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s (%s, RFC 8216 section %s)", pos, d.Severity, d.Message, d.Tag, d.Section)
+}
+
+func (m *M3u8) issue(severity Severity, line int, tag, section, message string) {
+	m.issues = append(m.issues, Diagnostic{Severity: severity, Line: line, Tag: tag, Section: section, Message: message})
+}
+
+// tagName returns the name of the tag on a line, e.g. EXT-X-KEY for #EXT-X-KEY:METHOD=NONE
+func tagName(line string) string {
+	name := strings.TrimPrefix(line, "#")
+	if idx := strings.IndexByte(name, ':'); idx >= 0 {
+		name = name[:idx]
+	}
+	return name
+}
+
+// Validate checks a parsed playlist against RFC 8216 and returns the problems found, sorted by line.
+// Problems the parser skipped over, like an EXTINF without URI, are included.
+func Validate(m *M3u8) []Diagnostic {
+	v := &M3u8{tagLines: m.tagLines}
+	v.issues = append(v.issues, m.issues...)
+	if m.IsMaster() {
+		if len(m.Segments) > 0 {
+			v.issue(SeverityError, m.Segments[0].Line, "EXTINF", "4.1", "master playlist tags mixed with media segments")
+		}
+		validateMaster(v, m)
+	} else {
+		validateMedia(v, m)
+	}
+	validateVersion(v, m)
+	sort.SliceStable(v.issues, func(i, j int) bool {
+		return v.issues[i].Line < v.issues[j].Line
+	})
+	return v.issues
+}
+
+func validateMedia(v *M3u8, m *M3u8) {
+	if len(m.Segments) == 0 {
+		v.issue(SeverityError, 0, "EXTINF", "4.3.3", "media playlist without media segments")
+		return
+	}
+	if m.TargetDuration <= 0 {
+		v.issue(SeverityError, 0, "EXT-X-TARGETDURATION", "4.3.3.1", "missing EXT-X-TARGETDURATION")
+	}
+	for _, seg := range m.Segments {
+		// EXTINF durations rounded to the nearest integer must not exceed the target duration
+		if m.TargetDuration > 0 && math.Round(float64(seg.Duration)) > m.TargetDuration {
+			v.issue(SeverityError, seg.Line, "EXTINF", "4.3.3.1",
+				fmt.Sprintf("duration %g exceeds EXT-X-TARGETDURATION %s", seg.Duration, formatFloat(m.TargetDuration)))
+		}
+	}
+	if m.PlaylistType == PlaylistTypeVOD && !m.EndList {
+		v.issue(SeverityWarning, v.tagLines["EXT-X-PLAYLIST-TYPE"], "EXT-X-ENDLIST", "4.3.3.5", "VOD playlist without EXT-X-ENDLIST")
+	}
+	for _, idx := range sortedKeyIndexes(m) {
+		key := m.Keys[idx]
+		switch {
+		case key.Method == CryptMethodNONE && (key.URI != "" || key.HasIV):
+			v.issue(SeverityError, key.Line, "EXT-X-KEY", "4.3.2.4", "METHOD=NONE with URI or IV")
+		case key.Method == "":
+			v.issue(SeverityError, key.Line, "EXT-X-KEY", "4.3.2.4", "missing METHOD")
+		case key.Method != CryptMethodNONE && key.URI == "":
+			v.issue(SeverityError, key.Line, "EXT-X-KEY", "4.3.2.4", fmt.Sprintf("METHOD=%s without URI", key.Method))
+		}
+	}
+	for _, dr := range m.DateRanges {
+		if !dr.EndDate.IsZero() && dr.EndDate.Before(dr.StartDate) {
+			v.issue(SeverityError, dr.Line, "EXT-X-DATERANGE", "4.3.2.7", fmt.Sprintf("END-DATE of %q before its START-DATE", dr.ID))
+		}
+		if dr.EndOnNext && dr.Class == "" {
+			v.issue(SeverityError, dr.Line, "EXT-X-DATERANGE", "4.3.2.7", fmt.Sprintf("END-ON-NEXT without CLASS on %q", dr.ID))
+		}
+	}
+}
+
+func validateMaster(v *M3u8, m *M3u8) {
+	for _, mp := range m.MasterPlaylist {
+		if mp.BandWidth == 0 {
+			v.issue(SeverityError, mp.Line, "EXT-X-STREAM-INF", "4.3.4.2", "missing BANDWIDTH")
+		}
+		groups := []struct {
+			t  MediaType
+			id string
+		}{
+			{MediaTypeAudio, mp.Audio},
+			{MediaTypeVideo, mp.Video},
+			{MediaTypeSubtitles, mp.Subtitles},
+			{MediaTypeClosedCaptions, mp.ClosedCaptions},
+		}
+		for _, g := range groups {
+			if g.id == "" || g.t == MediaTypeClosedCaptions && g.id == "NONE" {
+				continue
+			}
+			if len(m.MediaGroup(g.t, g.id)) == 0 {
+				v.issue(SeverityError, mp.Line, "EXT-X-STREAM-INF", "4.3.4.2",
+					fmt.Sprintf("%s group %q has no EXT-X-MEDIA", g.t, g.id))
+			}
+		}
+	}
+	for _, sd := range m.SessionData {
+		if (sd.Value == "") == (sd.URI == "") {
+			v.issue(SeverityError, v.tagLines["EXT-X-SESSION-DATA"], "EXT-X-SESSION-DATA", "4.3.4.4",
+				fmt.Sprintf("%q needs either VALUE or URI", sd.DataID))
+		}
+	}
+	for _, key := range m.SessionKeys {
+		if key.Method == "" || key.Method == CryptMethodNONE {
+			v.issue(SeverityError, key.Line, "EXT-X-SESSION-KEY", "4.3.4.5", "METHOD must not be NONE")
+		}
+	}
+	for _, mp := range m.IFrameStreams {
+		if mp.BandWidth == 0 {
+			v.issue(SeverityError, mp.Line, "EXT-X-I-FRAME-STREAM-INF", "4.3.4.3", "missing BANDWIDTH")
+		}
+	}
+	for _, media := range m.Medias {
+		if media.Type == MediaTypeClosedCaptions && media.URI != "" {
+			v.issue(SeverityError, media.Line, "EXT-X-MEDIA", "4.3.4.1", "CLOSED-CAPTIONS rendition with URI")
+		}
+		if media.Type == MediaTypeClosedCaptions && media.InstreamID == "" {
+			v.issue(SeverityError, media.Line, "EXT-X-MEDIA", "4.3.4.1", "CLOSED-CAPTIONS rendition without INSTREAM-ID")
+		}
+	}
+}
+
+// validateVersion reports tags and attributes that need a higher EXT-X-VERSION, see RFC 8216 section 7
+func validateVersion(v *M3u8, m *M3u8) {
+	version := int(m.Version)
+	if version == 0 {
+		version = 1
+	}
+	require := func(min int, line int, tag, what string) {
+		if version < min {
+			v.issue(SeverityWarning, line, tag, "7", fmt.Sprintf("%s requires EXT-X-VERSION %d or higher, playlist declares %d", what, min, version))
+		}
+	}
+	for _, idx := range sortedKeyIndexes(m) {
+		key := m.Keys[idx]
+		if key.HasIV {
+			require(2, key.Line, "EXT-X-KEY", "IV attribute")
+		}
+		if key.KeyFormat != "" || key.KeyFormatVersions != "" {
+			require(5, key.Line, "EXT-X-KEY", "KEYFORMAT attribute")
+		}
+		if key.Method == CryptMethodSampleAES || key.Method == CryptMethodSampleAESCTR {
+			require(5, key.Line, "EXT-X-KEY", "METHOD="+string(key.Method))
+		}
+	}
+	for _, seg := range m.Segments {
+		if seg.Duration != float32(math.Trunc(float64(seg.Duration))) {
+			require(3, seg.Line, "EXTINF", "floating-point duration")
+			break
+		}
+	}
+	if line := v.tagLines["EXT-X-BYTERANGE"]; line > 0 {
+		require(4, line, "EXT-X-BYTERANGE", "EXT-X-BYTERANGE")
+	}
+	if line := v.tagLines["EXT-X-I-FRAMES-ONLY"]; line > 0 {
+		require(4, line, "EXT-X-I-FRAMES-ONLY", "EXT-X-I-FRAMES-ONLY")
+	}
+	if line := v.tagLines["EXT-X-MAP"]; line > 0 {
+		if m.IFramesOnly {
+			require(5, line, "EXT-X-MAP", "EXT-X-MAP")
+		} else {
+			require(6, line, "EXT-X-MAP", "EXT-X-MAP in a playlist without EXT-X-I-FRAMES-ONLY")
+		}
+	}
+	if line := v.tagLines["EXT-X-DEFINE"]; line > 0 {
+		require(8, line, "EXT-X-DEFINE", "EXT-X-DEFINE")
+	}
+	for _, media := range m.Medias {
+		if strings.HasPrefix(media.InstreamID, "SERVICE") {
+			require(7, media.Line, "EXT-X-MEDIA", "INSTREAM-ID="+media.InstreamID)
+		}
+	}
+	if m.Skip != nil {
+		if len(m.Skip.RecentlyRemovedDateRanges) > 0 {
+			require(10, v.tagLines["EXT-X-SKIP"], "EXT-X-SKIP", "RECENTLY-REMOVED-DATERANGES")
+		} else {
+			require(9, v.tagLines["EXT-X-SKIP"], "EXT-X-SKIP", "EXT-X-SKIP")
+		}
+	}
+}
+
+func sortedKeyIndexes(m *M3u8) []int {
+	indexes := make([]int, 0, len(m.Keys))
+	for idx := range m.Keys {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,52 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	playlist := `#EXTM3U
+#EXT-X-TARGETDURATION:5
+#EXT-X-KEY:METHOD=AES-128,IV=0x1
+#EXTINF:6.5,
+a.ts
+stray.ts
+#EXT-X-BYTERANGE:100@0
+#EXTINF:5,
+`
+	m, err := Parse(strings.NewReader(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		severity Severity
+		line     int
+		section  string
+	}{
+		{SeverityError, 3, "4.3.2.4"},
+		{SeverityWarning, 3, "7"},
+		{SeverityError, 4, "4.3.3.1"},
+		{SeverityWarning, 4, "7"},
+		{SeverityError, 6, "4.3.2.1"},
+		{SeverityWarning, 7, "7"},
+		{SeverityError, 8, "4.3.2.1"},
+	}
+	diagnostics := Validate(m)
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("wrong number of diagnostics, expected: %d, result: %v", len(expected), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.Severity != expected[i].severity || d.Line != expected[i].line || d.Section != expected[i].section {
+			t.Fatalf("wrong diagnostic %d, expected: %v, result: %s", i, expected[i], d)
+		}
+	}
+
+	valid := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXTINF:9.5,\n0.ts\n#EXT-X-ENDLIST\n"
+	if m, err = Parse(strings.NewReader(valid)); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics := Validate(m); len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
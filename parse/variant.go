@@ -0,0 +1,131 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VariantSelector picks the variant stream of a master playlist to download,
+// it returns nil if none of the variants is acceptable.
+type VariantSelector func(variants []*MasterPlaylist) *MasterPlaylist
+
+// SelectFirst keeps the first variant, the order chosen by the playlist author
+func SelectFirst(variants []*MasterPlaylist) *MasterPlaylist {
+	if len(variants) == 0 {
+		return nil
+	}
+	return variants[0]
+}
+
+// SelectHighestBandwidth picks the variant with the highest BANDWIDTH
+func SelectHighestBandwidth(variants []*MasterPlaylist) *MasterPlaylist {
+	var best *MasterPlaylist
+	for _, v := range variants {
+		if best == nil || v.BandWidth > best.BandWidth {
+			best = v
+		}
+	}
+	return best
+}
+
+// SelectLowestBandwidth picks the variant with the lowest BANDWIDTH
+func SelectLowestBandwidth(variants []*MasterPlaylist) *MasterPlaylist {
+	var best *MasterPlaylist
+	for _, v := range variants {
+		if best == nil || v.BandWidth < best.BandWidth {
+			best = v
+		}
+	}
+	return best
+}
+
+// SelectResolution picks the variant whose RESOLUTION is closest to width x height,
+// ties go to the higher bandwidth. Variants without RESOLUTION are only used as a last resort.
+func SelectResolution(width, height int) VariantSelector {
+	target := width * height
+	return func(variants []*MasterPlaylist) *MasterPlaylist {
+		var (
+			best     *MasterPlaylist
+			bestDiff = -1
+		)
+		for _, v := range variants {
+			w, h, ok := v.Dimensions()
+			if !ok {
+				continue
+			}
+			diff := w*h - target
+			if diff < 0 {
+				diff = -diff
+			}
+			if bestDiff < 0 || diff < bestDiff || diff == bestDiff && v.BandWidth > best.BandWidth {
+				best = v
+				bestDiff = diff
+			}
+		}
+		if best == nil {
+			return SelectHighestBandwidth(variants)
+		}
+		return best
+	}
+}
+
+// FilterCodecs narrows the variants to those whose every codec in CODECS starts with one of
+// the allowed prefixes, e.g. "avc1" or "mp4a", and lets next choose among them.
+func FilterCodecs(allowed []string, next VariantSelector) VariantSelector {
+	return func(variants []*MasterPlaylist) *MasterPlaylist {
+		var filtered []*MasterPlaylist
+		for _, v := range variants {
+			if v.codecsAllowed(allowed) {
+				filtered = append(filtered, v)
+			}
+		}
+		return next(filtered)
+	}
+}
+
+// FilterMaxBandwidth narrows the variants to those with a BANDWIDTH of at most max bits/s,
+// and lets next choose among them.
+func FilterMaxBandwidth(max uint32, next VariantSelector) VariantSelector {
+	return func(variants []*MasterPlaylist) *MasterPlaylist {
+		var filtered []*MasterPlaylist
+		for _, v := range variants {
+			if v.BandWidth <= max {
+				filtered = append(filtered, v)
+			}
+		}
+		return next(filtered)
+	}
+}
+
+// Dimensions returns the width and height of RESOLUTION
+func (mp *MasterPlaylist) Dimensions() (width int, height int, ok bool) {
+	if _, err := fmt.Sscanf(mp.Resolution, "%dx%d", &width, &height); err != nil {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// codecsAllowed reports whether CODECS is not empty and each of its codecs has an allowed prefix
+func (mp *MasterPlaylist) codecsAllowed(allowed []string) bool {
+	found := false
+	for _, codec := range strings.Split(mp.Codecs, ",") {
+		codec = strings.TrimSpace(codec)
+		if codec == "" {
+			continue
+		}
+		if !hasAnyPrefix(codec, allowed) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package parse
+
+import "testing"
+
+func TestVariantSelector(t *testing.T) {
+	variants := []*MasterPlaylist{
+		{URI: "low.m3u8", BandWidth: 500000, Resolution: "640x360", Codecs: "avc1.42e01e,mp4a.40.2"},
+		{URI: "hevc.m3u8", BandWidth: 4000000, Resolution: "1920x1080", Codecs: "hvc1.2.4.L123.B0,mp4a.40.2"},
+		{URI: "mid.m3u8", BandWidth: 2000000, Resolution: "1280x720", Codecs: "avc1.4d401f,mp4a.40.2"},
+	}
+	cases := []struct {
+		selector VariantSelector
+		expected string
+	}{
+		{SelectFirst, "low.m3u8"},
+		{SelectHighestBandwidth, "hevc.m3u8"},
+		{SelectLowestBandwidth, "low.m3u8"},
+		{SelectResolution(1280, 700), "mid.m3u8"},
+		{FilterCodecs([]string{"avc1", "mp4a"}, SelectHighestBandwidth), "mid.m3u8"},
+		{FilterMaxBandwidth(1000000, SelectHighestBandwidth), "low.m3u8"},
+	}
+	for i, c := range cases {
+		result := c.selector(variants)
+		if result == nil || result.URI != c.expected {
+			t.Fatalf("case %d: wrong variant, expected: %s, result: %+v", i, c.expected, result)
+		}
+	}
+	if FilterMaxBandwidth(1000, SelectFirst)(variants) != nil {
+		t.Fatalf("expected no variant below 1000 bits/s")
+	}
+	// Every codec of a variant has to be allowed, not only its audio
+	mixed := []*MasterPlaylist{{URI: "hevc.m3u8", BandWidth: 4000000, Codecs: "hvc1.1.6.L93.B0,mp4a.40.2"}}
+	if result := FilterCodecs([]string{"avc1", "mp4a"}, SelectFirst)(mixed); result != nil {
+		t.Fatalf("expected the HEVC variant to be rejected, result: %+v", result)
+	}
+}
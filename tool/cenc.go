@@ -0,0 +1,507 @@
+package tool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Common Encryption (ISO/IEC 23001-7) of fragmented MP4 segments, used by SAMPLE-AES ('cbcs')
+// and SAMPLE-AES-CTR ('cenc'). Samples are decrypted in place, their sizes do not change.
+
+// TrackEncryption holds the protection parameters of a track from its 'tenc' box
+type TrackEncryption struct {
+	Scheme          string // cenc, cens, cbc1 or cbcs
+	PerSampleIVSize int
+	ConstantIV      []byte
+	CryptByteBlock  int
+	SkipByteBlock   int
+}
+
+// PIFF sample encryption box, the predecessor of 'senc'
+var piffSampleEncryption = []byte{0xa2, 0x39, 0x4f, 0x52, 0x5a, 0x9b, 0x4f, 0x14, 0xa2, 0x44, 0x6c, 0x42, 0x7c, 0x64, 0x8d, 0xf4}
+
+type mp4Box struct {
+	typ    string
+	start  int // offset of the box header
+	offset int // offset of the box body
+	end    int
+}
+
+// mp4Boxes lists the boxes of data[start:end]
+func mp4Boxes(data []byte, start, end int) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for pos := start; pos+8 <= end; {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		header := 8
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if pos+16 > end {
+				return nil, errors.New("truncated box header")
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < header || pos+size > end {
+			return nil, fmt.Errorf("invalid size of box %q", data[pos+4:pos+8])
+		}
+		boxes = append(boxes, mp4Box{typ: string(data[pos+4 : pos+8]), start: pos, offset: pos + header, end: pos + size})
+		pos += size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// ClearInitSection reads the protection parameters of every encrypted track of an init section and
+// rewrites it in place to announce clear samples: encv/enca sample entries get their original format
+// back and their 'sinf' box becomes a 'free' box. It returns the parameters by track ID, empty if
+// no track is encrypted.
+func ClearInitSection(init []byte) (map[uint32]*TrackEncryption, error) {
+	tracks := make(map[uint32]*TrackEncryption)
+	top, err := mp4Boxes(init, 0, len(init))
+	if err != nil {
+		return nil, err
+	}
+	moov := findBox(top, "moov")
+	if moov == nil {
+		return nil, errors.New("missing moov box")
+	}
+	traks, err := mp4Boxes(init, moov.offset, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range traks {
+		if trak.typ != "trak" {
+			continue
+		}
+		trackID, enc, err := clearTrack(init, trak)
+		if err != nil {
+			return nil, err
+		}
+		if enc != nil {
+			tracks[trackID] = enc
+		}
+	}
+	return tracks, nil
+}
+
+func clearTrack(init []byte, trak mp4Box) (uint32, *TrackEncryption, error) {
+	children, err := mp4Boxes(init, trak.offset, trak.end)
+	if err != nil {
+		return 0, nil, err
+	}
+	tkhd := findBox(children, "tkhd")
+	if tkhd == nil {
+		return 0, nil, errors.New("missing tkhd box")
+	}
+	// track_ID follows the creation and modification times, 64 bits wide in version 1
+	idOffset := tkhd.offset + 12
+	if tkhd.end > tkhd.offset && init[tkhd.offset] == 1 {
+		idOffset = tkhd.offset + 20
+	}
+	if idOffset+4 > tkhd.end {
+		return 0, nil, errors.New("truncated tkhd box")
+	}
+	trackID := binary.BigEndian.Uint32(init[idOffset:])
+	box := &trak
+	for _, typ := range []string{"mdia", "minf", "stbl", "stsd"} {
+		children, err := mp4Boxes(init, box.offset, box.end)
+		if err != nil {
+			return 0, nil, err
+		}
+		if box = findBox(children, typ); box == nil {
+			return trackID, nil, nil
+		}
+	}
+	// stsd is a full box followed by the entry count
+	if box.offset+8 > box.end {
+		return 0, nil, errors.New("truncated stsd box")
+	}
+	entries, err := mp4Boxes(init, box.offset+8, box.end)
+	if err != nil {
+		return 0, nil, err
+	}
+	var enc *TrackEncryption
+	for _, entry := range entries {
+		var fixed int
+		switch entry.typ {
+		case "encv":
+			fixed = 78
+		case "enca":
+			fixed = 28
+		default:
+			continue
+		}
+		if entry.offset+fixed > entry.end {
+			return 0, nil, fmt.Errorf("truncated %s box", entry.typ)
+		}
+		children, err := mp4Boxes(init, entry.offset+fixed, entry.end)
+		if err != nil {
+			return 0, nil, err
+		}
+		sinf := findBox(children, "sinf")
+		if sinf == nil {
+			continue
+		}
+		if enc, err = parseSinf(init, entry, *sinf); err != nil {
+			return 0, nil, err
+		}
+		copy(init[sinf.start+4:], "free")
+	}
+	return trackID, enc, nil
+}
+
+func parseSinf(init []byte, entry mp4Box, sinf mp4Box) (*TrackEncryption, error) {
+	children, err := mp4Boxes(init, sinf.offset, sinf.end)
+	if err != nil {
+		return nil, err
+	}
+	frma, schm, schi := findBox(children, "frma"), findBox(children, "schm"), findBox(children, "schi")
+	if frma == nil || schm == nil || schi == nil || frma.end-frma.offset < 4 || schm.end-schm.offset < 8 {
+		return nil, errors.New("incomplete sinf box")
+	}
+	enc := &TrackEncryption{Scheme: string(init[schm.offset+4 : schm.offset+8])}
+	schiChildren, err := mp4Boxes(init, schi.offset, schi.end)
+	if err != nil {
+		return nil, err
+	}
+	tenc := findBox(schiChildren, "tenc")
+	if tenc == nil || tenc.end-tenc.offset < 24 {
+		return nil, errors.New("missing tenc box")
+	}
+	body := init[tenc.offset:tenc.end]
+	if body[0] > 0 {
+		enc.CryptByteBlock = int(body[5] >> 4)
+		enc.SkipByteBlock = int(body[5] & 0x0f)
+	}
+	enc.PerSampleIVSize = int(body[7])
+	if body[6] == 1 && enc.PerSampleIVSize == 0 && len(body) > 24 {
+		size := int(body[24])
+		if 25+size > len(body) {
+			return nil, errors.New("truncated constant IV")
+		}
+		enc.ConstantIV = append([]byte(nil), body[25:25+size]...)
+	}
+	// Restore the original sample entry type
+	copy(init[entry.start+4:entry.start+8], init[frma.offset:frma.offset+4])
+	return enc, nil
+}
+
+type sampleEncryption struct {
+	iv         []byte
+	subsamples [][2]int // clear and protected byte counts
+}
+
+// DecryptFMP4Segment decrypts the samples of a fragmented MP4 media segment in place. tracks are the
+// parameters returned by ClearInitSection, iv is used for tracks without per-sample or constant IVs.
+func DecryptFMP4Segment(segment []byte, tracks map[uint32]*TrackEncryption, key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	top, err := mp4Boxes(segment, 0, len(segment))
+	if err != nil {
+		return err
+	}
+	for _, moof := range top {
+		if moof.typ != "moof" {
+			continue
+		}
+		trafs, err := mp4Boxes(segment, moof.offset, moof.end)
+		if err != nil {
+			return err
+		}
+		for _, traf := range trafs {
+			if traf.typ != "traf" {
+				continue
+			}
+			if err := decryptTraf(segment, moof, traf, tracks, block, iv); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decryptTraf(segment []byte, moof, traf mp4Box, tracks map[uint32]*TrackEncryption, block cipher.Block, iv []byte) error {
+	children, err := mp4Boxes(segment, traf.offset, traf.end)
+	if err != nil {
+		return err
+	}
+	tfhd := findBox(children, "tfhd")
+	if tfhd == nil {
+		return errors.New("missing tfhd box")
+	}
+	if tfhd.end-tfhd.offset < 8 {
+		return errors.New("truncated tfhd box")
+	}
+	flags := binary.BigEndian.Uint32(segment[tfhd.offset:]) & 0xffffff
+	trackID := binary.BigEndian.Uint32(segment[tfhd.offset+4:])
+	enc, ok := tracks[trackID]
+	if !ok {
+		return nil
+	}
+	// Optional fields in order: base data offset, sample description index, default duration and size
+	var size int
+	for _, f := range [][2]uint32{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+		if flags&f[0] != 0 {
+			size += int(f[1])
+		}
+	}
+	if tfhd.offset+8+size > tfhd.end {
+		return errors.New("truncated tfhd box")
+	}
+	pos := tfhd.offset + 8
+	base := moof.start
+	if flags&0x01 != 0 {
+		base = int(binary.BigEndian.Uint64(segment[pos:]))
+		pos += 8
+	}
+	if flags&0x02 != 0 {
+		pos += 4
+	}
+	if flags&0x08 != 0 {
+		pos += 4
+	}
+	defaultSize := 0
+	if flags&0x10 != 0 {
+		defaultSize = int(binary.BigEndian.Uint32(segment[pos:]))
+	}
+
+	var samples []sampleEncryption
+	for _, child := range children {
+		isPIFF := child.typ == "uuid" && child.end-child.offset > 16 && bytes.Equal(segment[child.offset:child.offset+16], piffSampleEncryption)
+		if child.typ != "senc" && !isPIFF {
+			continue
+		}
+		body := segment[child.offset:child.end]
+		if isPIFF {
+			body = body[16:]
+		}
+		if samples, err = parseSenc(body, enc.PerSampleIVSize); err != nil {
+			return err
+		}
+	}
+
+	index := 0
+	for _, trun := range children {
+		if trun.typ != "trun" {
+			continue
+		}
+		sizes, dataOffset, err := parseTrun(segment[trun.offset:trun.end], defaultSize, len(segment))
+		if err != nil {
+			return err
+		}
+		offset := base + dataOffset
+		for _, size := range sizes {
+			if offset < 0 || offset+size > len(segment) {
+				return errors.New("sample data out of range")
+			}
+			var sample sampleEncryption
+			if index < len(samples) {
+				sample = samples[index]
+			}
+			sampleIV := sample.iv
+			if len(sampleIV) == 0 {
+				sampleIV = enc.ConstantIV
+			}
+			if len(sampleIV) == 0 {
+				sampleIV = iv
+			}
+			decryptSample(segment[offset:offset+size], sample.subsamples, enc, block, sampleIV)
+			offset += size
+			index++
+		}
+	}
+	return nil
+}
+
+func parseSenc(body []byte, ivSize int) ([]sampleEncryption, error) {
+	if len(body) < 8 {
+		return nil, errors.New("truncated senc box")
+	}
+	flags := binary.BigEndian.Uint32(body) & 0xffffff
+	pos := 4
+	if flags&0x01 != 0 {
+		// PIFF override of the algorithm, IV size and KID
+		if pos+24 > len(body) {
+			return nil, errors.New("truncated senc box")
+		}
+		ivSize = int(body[pos+3])
+		pos += 20
+	}
+	count := int(binary.BigEndian.Uint32(body[pos:]))
+	pos += 4
+	// Every sample takes its IV and subsample count, samples without either carry no information
+	perSample := ivSize
+	if flags&0x02 != 0 {
+		perSample += 2
+	}
+	if perSample == 0 {
+		return nil, nil
+	}
+	if max := (len(body) - pos) / perSample; count > max {
+		return nil, errors.New("truncated senc box")
+	}
+	samples := make([]sampleEncryption, 0, count)
+	for i := 0; i < count; i++ {
+		if pos+ivSize > len(body) {
+			return nil, errors.New("truncated senc box")
+		}
+		sample := sampleEncryption{iv: body[pos : pos+ivSize]}
+		pos += ivSize
+		if flags&0x02 != 0 {
+			if pos+2 > len(body) {
+				return nil, errors.New("truncated senc box")
+			}
+			n := int(binary.BigEndian.Uint16(body[pos:]))
+			pos += 2
+			if pos+6*n > len(body) {
+				return nil, errors.New("truncated senc box")
+			}
+			for j := 0; j < n; j++ {
+				sample.subsamples = append(sample.subsamples, [2]int{
+					int(binary.BigEndian.Uint16(body[pos:])),
+					int(binary.BigEndian.Uint32(body[pos+2:])),
+				})
+				pos += 6
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// parseTrun returns the sample sizes of a track run and its data offset,
+// dataSize bounds the number of samples of runs without per-sample fields
+func parseTrun(body []byte, defaultSize int, dataSize int) ([]int, int, error) {
+	if len(body) < 8 {
+		return nil, 0, errors.New("truncated trun box")
+	}
+	flags := binary.BigEndian.Uint32(body) & 0xffffff
+	count := int(binary.BigEndian.Uint32(body[4:]))
+	pos := 8
+	dataOffset := 0
+	if flags&0x01 != 0 {
+		if pos+4 > len(body) {
+			return nil, 0, errors.New("truncated trun box")
+		}
+		dataOffset = int(int32(binary.BigEndian.Uint32(body[pos:])))
+		pos += 4
+	}
+	if flags&0x04 != 0 {
+		if pos+4 > len(body) {
+			return nil, 0, errors.New("truncated trun box")
+		}
+		pos += 4
+	}
+	// Duration, size, flags and composition time offset, 4 bytes each
+	perSample := 0
+	for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&f != 0 {
+			perSample += 4
+		}
+	}
+	if perSample > 0 {
+		if max := (len(body) - pos) / perSample; count > max {
+			return nil, 0, errors.New("truncated trun box")
+		}
+	} else if defaultSize > 0 && count > dataSize/defaultSize || count > dataSize {
+		return nil, 0, errors.New("trun box has more samples than the segment")
+	}
+	sizes := make([]int, 0, count)
+	for i := 0; i < count; i++ {
+		size := defaultSize
+		if flags&0x100 != 0 {
+			pos += 4
+		}
+		if flags&0x200 != 0 {
+			size = int(binary.BigEndian.Uint32(body[pos:]))
+			pos += 4
+		}
+		if flags&0x400 != 0 {
+			pos += 4
+		}
+		if flags&0x800 != 0 {
+			pos += 4
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, dataOffset, nil
+}
+
+// decryptSample decrypts one sample in place according to the protection scheme
+func decryptSample(sample []byte, subsamples [][2]int, enc *TrackEncryption, block cipher.Block, iv []byte) {
+	if len(subsamples) == 0 {
+		subsamples = [][2]int{{0, len(sample)}}
+	}
+	fullIV := make([]byte, 16)
+	copy(fullIV, iv)
+	ctr := enc.Scheme == "cenc" || enc.Scheme == "cens"
+	var (
+		stream cipher.Stream
+		mode   cipher.BlockMode
+	)
+	reset := func() {
+		if ctr {
+			stream = cipher.NewCTR(block, fullIV)
+		} else {
+			mode = cipher.NewCBCDecrypter(block, fullIV)
+		}
+	}
+	reset()
+	pos := 0
+	for _, sub := range subsamples {
+		pos += sub[0]
+		end := pos + sub[1]
+		if end > len(sample) {
+			end = len(sample)
+		}
+		if pos >= end {
+			continue
+		}
+		if enc.Scheme == "cbcs" {
+			// The constant IV applies to every subsample
+			reset()
+		}
+		protected := sample[pos:end]
+		pos = end
+		if enc.CryptByteBlock == 0 {
+			if ctr {
+				stream.XORKeyStream(protected, protected)
+			} else if n := len(protected) / 16 * 16; n > 0 {
+				mode.CryptBlocks(protected[:n], protected[:n])
+			}
+			continue
+		}
+		// Pattern encryption: crypt blocks encrypted, skip blocks in the clear
+		for p := 0; p < len(protected); {
+			n := enc.CryptByteBlock * 16
+			if rest := (len(protected) - p) / 16 * 16; n > rest {
+				n = rest
+			}
+			if n == 0 {
+				break
+			}
+			if ctr {
+				stream.XORKeyStream(protected[p:p+n], protected[p:p+n])
+			} else {
+				mode.CryptBlocks(protected[p:p+n], protected[p:p+n])
+			}
+			p += n + enc.SkipByteBlock*16
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package tool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+)
+
+func testBox(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// testInitSection returns the init section of one encv track 1 with the tenc body given
+func testInitSection(scheme string, tenc []byte) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	schm := append([]byte{0, 0, 0, 0}, scheme...)
+	schm = append(schm, 0, 1, 0, 0)
+	sinf := testBox("sinf", testBox("frma", []byte("avc1")), testBox("schm", schm), testBox("schi", testBox("tenc", tenc)))
+	stsd := testBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, testBox("encv", make([]byte, 78), sinf))
+	return testBox("moov", testBox("trak", testBox("tkhd", tkhd), testBox("mdia", testBox("minf", testBox("stbl", stsd)))))
+}
+
+// testSegment returns a media segment of track 1 with the samples and senc body given
+func testSegment(samples [][]byte, senc []byte) []byte {
+	tfhd := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+	trun := make([]byte, 12)
+	binary.BigEndian.PutUint32(trun, 0x201)
+	binary.BigEndian.PutUint32(trun[4:], uint32(len(samples)))
+	var mdat []byte
+	for _, s := range samples {
+		trun = appendUint32(trun, uint32(len(s)))
+		mdat = append(mdat, s...)
+	}
+	moof := testBox("moof", testBox("mfhd", make([]byte, 8)), testBox("traf", testBox("tfhd", tfhd), testBox("trun", trun), testBox("senc", senc)))
+	// The data offset is relative to the moof box, mdat follows it
+	dataOffset := bytes.Index(moof, []byte("trun")) + 4 + 8
+	binary.BigEndian.PutUint32(moof[dataOffset:], uint32(len(moof)+8))
+	return append(moof, testBox("mdat", mdat)...)
+}
+
+func TestDecryptFMP4Segment(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	block, _ := aes.NewCipher(key)
+	plain := [][]byte{make([]byte, 200), make([]byte, 96)}
+	for _, s := range plain {
+		for i := range s {
+			s[i] = byte(i * 7)
+		}
+	}
+	subsamples := [][2]int{{16, 184}, {5, 91}}
+	cbcsIV := []byte("fedcba9876543210")
+
+	tests := []struct {
+		scheme  string
+		tenc    []byte
+		ivs     [][]byte // per sample IVs written to senc
+		encrypt func(protected []byte, iv []byte)
+	}{
+		{
+			scheme: "cenc",
+			tenc:   append([]byte{0, 0, 0, 0, 0, 0, 1, 8}, make([]byte, 16)...),
+			ivs:    [][]byte{[]byte("ivsample"), []byte("ivnumber")},
+			encrypt: func(protected []byte, iv []byte) {
+				fullIV := append(append([]byte(nil), iv...), make([]byte, 8)...)
+				cipher.NewCTR(block, fullIV).XORKeyStream(protected, protected)
+			},
+		},
+		{
+			scheme: "cbcs",
+			tenc:   append(append(append([]byte{1, 0, 0, 0, 0, 0x19, 1, 0}, make([]byte, 16)...), 16), cbcsIV...),
+			ivs:    [][]byte{nil, nil},
+			encrypt: func(protected []byte, _ []byte) {
+				// One encrypted block out of ten, the CBC chain restarts with every subsample
+				mode := cipher.NewCBCEncrypter(block, cbcsIV)
+				for p := 0; p+16 <= len(protected); p += 160 {
+					mode.CryptBlocks(protected[p:p+16], protected[p:p+16])
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.scheme, func(t *testing.T) {
+			init := testInitSection(test.scheme, test.tenc)
+			tracks, err := ClearInitSection(init)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(init, []byte("avc1")) || bytes.Contains(init, []byte("encv")) || bytes.Contains(init, []byte("sinf")) {
+				t.Fatalf("init section not cleared: %q", init)
+			}
+			if tracks[1] == nil || tracks[1].Scheme != test.scheme {
+				t.Fatalf("wrong tracks: %+v", tracks)
+			}
+
+			senc := appendUint32([]byte{0, 0, 0, 2}, uint32(len(plain)))
+			var encrypted [][]byte
+			for i, s := range plain {
+				e := append([]byte(nil), s...)
+				sub := subsamples[i]
+				test.encrypt(e[sub[0]:sub[0]+sub[1]], test.ivs[i])
+				encrypted = append(encrypted, e)
+				senc = append(senc, test.ivs[i]...)
+				senc = appendUint16(senc, 1)
+				senc = appendUint16(senc, uint16(sub[0]))
+				senc = appendUint32(senc, uint32(sub[1]))
+			}
+			segment := testSegment(encrypted, senc)
+			if err := DecryptFMP4Segment(segment, tracks, key, make([]byte, 16)); err != nil {
+				t.Fatal(err)
+			}
+			if expected := testSegment(plain, senc); !bytes.Equal(segment, expected) {
+				t.Fatalf("wrong segment, expected: %x, result: %x", expected, segment)
+			}
+		})
+	}
+}
+
+func TestDecryptFMP4SegmentTruncated(t *testing.T) {
+	tracks := map[uint32]*TrackEncryption{1: {Scheme: "cenc", PerSampleIVSize: 8}}
+	key := []byte("0123456789abcdef")
+	truns := map[string][]byte{
+		"data offset":        {0, 0, 0, 0x01, 0, 0, 0, 1},
+		"first sample flags": {0, 0, 0, 0x04, 0, 0, 0, 1},
+		"sample sizes":       {0, 0, 0x02, 0x00, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 16},
+		"default sizes":      {0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, trun := range truns {
+		segment := testBox("moof", testBox("traf", testBox("tfhd", []byte{0, 0, 0, 0, 0, 0, 0, 1}), testBox("trun", trun)))
+		if err := DecryptFMP4Segment(segment, tracks, key, make([]byte, 16)); err == nil {
+			t.Errorf("%s: expected an error for a truncated trun box", name)
+		}
+	}
+	tfhds := map[string][]byte{
+		"track ID":         {0, 0, 0, 0},
+		"base data offset": {0, 0, 0, 0x01, 0, 0, 0, 1, 0, 0, 0, 0},
+		"default size":     {0, 0, 0, 0x10, 0, 0, 0, 1},
+	}
+	for name, tfhd := range tfhds {
+		segment := testBox("moof", testBox("traf", testBox("tfhd", tfhd)))
+		if err := DecryptFMP4Segment(segment, tracks, key, make([]byte, 16)); err == nil {
+			t.Errorf("%s: expected an error for a truncated tfhd box", name)
+		}
+	}
+	senc := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5, 6, 7, 8}
+	segment := testBox("moof", testBox("traf", testBox("tfhd", []byte{0, 0, 0, 0, 0, 0, 0, 1}), testBox("senc", senc)))
+	if err := DecryptFMP4Segment(segment, tracks, key, make([]byte, 16)); err == nil {
+		t.Error("expected an error for a truncated senc box")
+	}
+}
@@ -0,0 +1,287 @@
+package tool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ClientOptions configures a Client, zero values keep the defaults
+type ClientOptions struct {
+	Proxy                 *url.URL      // see ParseProxy for the supported proxies
+	Proxies               *ProxyPool    // rotates the requests over several proxies instead of Proxy
+	Timeout               time.Duration // whole request including reading the body, default 10 minutes
+	DialTimeout           time.Duration // default 30s
+	TLSHandshakeTimeout   time.Duration // default 10s
+	ResponseHeaderTimeout time.Duration // time to wait for the response headers after sending the request, default 30s
+	IdleConnTimeout       time.Duration // how long an idle connection is kept in the pool, default 90s
+	MaxIdleConns          int           // idle connections kept over all hosts, default 100
+	MaxIdleConnsPerHost   int           // idle connections kept per host, default 16
+	MaxConnsPerHost       int           // 0 means no limit
+	DisableHTTP2          bool
+	Limits                Limits
+	Jar                   http.CookieJar // keeps the cookies set by responses for later requests, nil sends none
+}
+
+// Client sends the requests of a task over a pool of reused connections
+type Client struct {
+	http      *http.Client
+	bandwidth *RateLimiter
+	hosts     *hostLimiter
+	proxies   *ProxyPool
+	opts      ClientOptions
+}
+
+// NewClient returns a Client, it is meant to be created once and shared by all requests of a task
+func NewClient(opts ClientOptions) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 10 * time.Minute
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 30 * time.Second
+	}
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if opts.ResponseHeaderTimeout == 0 {
+		opts.ResponseHeaderTimeout = 30 * time.Second
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = 90 * time.Second
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = 100
+	}
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = 16
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !opts.DisableHTTP2,
+	}
+	if opts.Proxy != nil {
+		// 设置代理
+		transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+	if opts.Proxies != nil {
+		transport.Proxy = poolProxyFunc
+	}
+	if opts.DisableHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	c := &Client{http: &http.Client{Timeout: opts.Timeout, Transport: transport, Jar: opts.Jar}, proxies: opts.Proxies, opts: opts}
+	return c.WithLimits(opts.Limits)
+}
+
+// WithLimits returns a Client sharing the connections of c, throttled by limits instead of the limits of c
+func (c *Client) WithLimits(limits Limits) *Client {
+	return &Client{http: c.http, bandwidth: newBandwidthLimiter(limits.Bandwidth), hosts: newHostLimiter(limits.HostRequestsPerSecond), proxies: c.proxies, opts: c.opts}
+}
+
+// WithProxy returns a Client sending its requests through proxy instead of the proxies of c.
+// It keeps the options and cookie jar of c and shares its limits, but not its connections.
+func (c *Client) WithProxy(proxy *url.URL) *Client {
+	opts := c.opts
+	opts.Proxy, opts.Proxies = proxy, nil
+	p := NewClient(opts)
+	p.bandwidth, p.hosts = c.bandwidth, c.hosts
+	return p
+}
+
+var proxyClients sync.Map
+
+// ProxyClient returns a Client with the default options shared by every caller using the same proxy,
+// proxy may be nil
+func ProxyClient(proxy *url.URL) *Client {
+	var id string
+	if proxy != nil {
+		id = proxy.String()
+	}
+	if c, ok := proxyClients.Load(id); ok {
+		return c.(*Client)
+	}
+	c, _ := proxyClients.LoadOrStore(id, NewClient(ClientOptions{Proxy: proxy}))
+	return c.(*Client)
+}
+
+func (c *Client) do(ctx context.Context, url string, headers map[string]string, setup func(req *http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range headers {
+		req.Header.Add(key, val)
+	}
+	if setup != nil {
+		setup(req)
+	}
+	globalBandwidth, globalHosts := globalLimiters()
+	resp, err := c.send(req, globalHosts)
+	if err != nil {
+		return nil, err
+	}
+	var limiters []*RateLimiter
+	for _, l := range []*RateLimiter{globalBandwidth, c.bandwidth} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if len(limiters) > 0 {
+		resp.Body = &throttledBody{ReadCloser: resp.Body, ctx: ctx, limiters: limiters}
+	}
+	return resp, nil
+}
+
+// send sends req through the next proxy of the pool, if any. A response quarantining the proxy
+// is retried at once through another proxy, as long as one is available.
+func (c *Client) send(req *http.Request, globalHosts *hostLimiter) (*http.Response, error) {
+	for {
+		if err := globalHosts.wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+		if err := c.hosts.wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+		if c.proxies == nil {
+			return c.http.Do(req)
+		}
+		proxy := c.proxies.pick()
+		resp, err := c.http.Do(withProxy(req, proxy))
+		if err != nil {
+			if req.Context().Err() == nil {
+				// A cancelled request says nothing about the proxy
+				c.proxies.report(proxy, 0, err)
+			}
+			return nil, err
+		}
+		if !c.proxies.report(proxy, resp.StatusCode, nil) || !c.proxies.available(proxy) {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+// Proxies returns the proxy pool of c, nil if it has none
+func (c *Client) Proxies() *ProxyPool {
+	return c.proxies
+}
+
+// Get requests url and returns the response body, which must be closed
+func (c *Client) Get(url string, headers map[string]string) (io.ReadCloser, error) {
+	return c.GetContext(context.Background(), url, headers)
+}
+
+// GetContext is Get cancelled with ctx, which also bounds reading the body
+func (c *Client) GetContext(ctx context.Context, url string, headers map[string]string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, url, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	return resp.Body, nil
+}
+
+// GetBytes requests url and returns the whole response body
+func (c *Client) GetBytes(url string, headers map[string]string) ([]byte, error) {
+	return c.GetBytesContext(context.Background(), url, headers)
+}
+
+// GetBytesContext is GetBytes cancelled with ctx
+func (c *Client) GetBytesContext(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	body, err := c.GetContext(ctx, url, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	// 用ioutil.ReadAll可能户内存溢出，自己重写ReadAll方法，把之前的512改为256
+	return ReadAll(body)
+}
+
+// GetRange requests length bytes of url starting at offset with a Range header,
+// the body of servers ignoring the header is sliced to the range instead.
+func (c *Client) GetRange(url string, headers map[string]string, offset uint64, length uint64) ([]byte, error) {
+	return c.GetRangeContext(context.Background(), url, headers, offset, length)
+}
+
+// GetRangeContext is GetRange cancelled with ctx
+func (c *Client) GetRangeContext(ctx context.Context, url string, headers map[string]string, offset uint64, length uint64) ([]byte, error) {
+	body, err := c.GetRangeReaderContext(ctx, url, headers, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ReadAll(body)
+}
+
+// GetRangeReaderContext is GetRangeContext returning the body of the range, which must be closed,
+// instead of reading it into memory
+func (c *Client) GetRangeReaderContext(ctx context.Context, url string, headers map[string]string, offset uint64, length uint64) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, url, headers, func(req *http.Request) {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(offset)); err != nil {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("range %d@%d beyond the end of the body: %s", length, offset, err.Error())
+		}
+	default:
+		_ = resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+	return &rangeBody{Reader: io.LimitReader(resp.Body, int64(length)), Closer: resp.Body}, nil
+}
+
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// StatusError is returned for responses with an unexpected status code
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // from the Retry-After header, 0 if there was none
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("http error: status code %d", e.StatusCode)
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	e := &StatusError{StatusCode: resp.StatusCode}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		// Either a number of seconds or an HTTP date
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			e.RetryAfter = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil && time.Until(t) > 0 {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
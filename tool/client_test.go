@@ -0,0 +1,40 @@
+package tool
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientReusesConnections(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("segment"))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewClient(ClientOptions{})
+	for i := 0; i < 5; i++ {
+		b, err := client.GetBytes(server.URL+"/0.ts", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "segment" {
+			t.Fatalf("wrong body: %q", b)
+		}
+	}
+	if conns != 1 {
+		t.Fatalf("wrong number of connections, expected: 1, result: %d", conns)
+	}
+	if ProxyClient(nil) != ProxyClient(nil) {
+		t.Fatal("clients of the same proxy are not shared")
+	}
+}
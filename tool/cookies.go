@@ -0,0 +1,85 @@
+package tool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpOnlyPrefix marks the HttpOnly cookies of curl and browser exports, which are otherwise comments
+const httpOnlyPrefix = "#HttpOnly_"
+
+// LoadCookies returns a cookie jar holding the cookies of a Netscape cookies.txt file
+func LoadCookies(path string) (*cookiejar.Jar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	jar, _ := cookiejar.New(nil)
+	if err := ReadCookies(jar, f); err != nil {
+		return nil, fmt.Errorf("cookies %s: %s", path, err.Error())
+	}
+	return jar, nil
+}
+
+// ReadCookies adds the cookies of a Netscape cookies.txt to jar, expired ones are skipped.
+// Every line has the tab separated fields domain, include subdomains, path, secure, expires, name and value.
+func ReadCookies(jar http.CookieJar, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	now := time.Now()
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = line[len(httpOnlyPrefix):]
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("line %d: expected 7 tab separated fields, got %d", lineNo, len(fields))
+		}
+		domain := strings.TrimPrefix(fields[0], ".")
+		if domain == "" {
+			return fmt.Errorf("line %d: empty domain", lineNo)
+		}
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		// Without a Domain attribute the cookie is only sent to the exact host
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expiry %q", lineNo, fields[4])
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+			if cookie.Expires.Before(now) {
+				continue
+			}
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: domain, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	return scanner.Err()
+}
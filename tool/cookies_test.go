@@ -0,0 +1,50 @@
+package tool
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCookies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.m3u8":
+			http.SetCookie(w, &http.Cookie{Name: "token", Value: "abc", Path: "/"})
+		case "/seg.ts":
+			token, err1 := r.Cookie("token")
+			session, err2 := r.Cookie("session")
+			if err1 != nil || err2 != nil || token.Value != "abc" || session.Value != "1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	jar, _ := cookiejar.New(nil)
+	err := ReadCookies(jar, strings.NewReader("# Netscape HTTP Cookie File\n"+
+		"#HttpOnly_"+u.Hostname()+"\tFALSE\t/\tFALSE\t0\tsession\t1\n"+
+		u.Hostname()+"\tFALSE\t/\tFALSE\t1\texpired\tx\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookies := jar.Cookies(u); len(cookies) != 1 || cookies[0].Name != "session" {
+		t.Fatalf("wrong cookies: %v", cookies)
+	}
+	c := NewClient(ClientOptions{Jar: jar})
+	if _, err := c.GetBytes(server.URL+"/index.m3u8", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBytes(server.URL+"/seg.ts", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadCookies(jar, strings.NewReader("example.com\tTRUE\t/\n")); err == nil {
+		t.Fatal("malformed line was accepted")
+	}
+}
@@ -24,14 +24,16 @@ func AES128Encrypt(origData, key, iv []byte) ([]byte, error) {
 	return crypted, nil
 }
 
+// AES128Decrypt decrypts an AES-128 CBC segment, iv must be the 16 bytes IV of the segment,
+// see parse.Key.SegmentIV
 func AES128Decrypt(crypted, key, iv []byte, url string) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	blockSize := block.BlockSize()
-	if len(iv) == 0 {
-		iv = key
+	if len(iv) != blockSize {
+		return nil, fmt.Errorf("invalid IV length %d, expected %d", len(iv), blockSize)
 	}
 	if len(crypted)%blockSize != 0 {
 		fmt.Println("len error ", len(crypted), ", url is ", url, ", retry")
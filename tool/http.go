@@ -1,10 +1,8 @@
 package tool
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"io"
-	"net/http"
 	"net/url"
 	"time"
 
@@ -24,41 +22,9 @@ var (
 	}
 )
 
+// GetByProxy requests url through the shared client of proxy uri, which may be nil
 func GetByProxy(url string, headers map[string]string, uri *url.URL) (io.ReadCloser, error) {
-
-	var c http.Client
-	if uri == nil {
-		c = http.Client{
-			Timeout: time.Duration(30) * time.Second,
-		}
-	} else {
-		c = http.Client{
-			Timeout: time.Duration(30) * time.Second,
-			Transport: &http.Transport{
-				// 设置代理
-				Proxy:                 http.ProxyURL(uri),
-				ExpectContinueTimeout: 30,
-			},
-		}
-	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	if nil != headers && len(headers) > 0 {
-		for key, val := range headers {
-			req.Header.Add(key, val)
-		}
-	}
-	resp, err := c.Do(req)
-	// resp, err := c.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("http error: status code %d", resp.StatusCode)
-	}
-	return resp.Body, nil
+	return ProxyClient(uri).Get(url, headers)
 }
 
 func Get(url string, headers map[string]string) (io.ReadCloser, error) {
@@ -70,54 +36,17 @@ func GetBytes(url string, headers map[string]string) ([]byte, error) {
 }
 
 func GetBytesByProxy(url string, headers map[string]string, uri *url.URL) ([]byte, error) {
-	var c http.Client
-	if uri == nil {
-		c = http.Client{
-			Timeout: time.Duration(30) * time.Second,
-		}
-	} else {
-		c = http.Client{
-			// Timeout: time.Duration(30) * time.Second,
-			Transport: &http.Transport{
-				// 设置代理
-				Proxy: http.ProxyURL(uri),
-				// ExpectContinueTimeout: 30,
-			},
-		}
-	}
+	return ProxyClient(uri).GetBytes(url, headers)
+}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	if nil != headers && len(headers) > 0 {
-		for key, val := range headers {
-			req.Header.Add(key, val)
-		}
-	}
-	resp, err := c.Do(req)
-	// resp, err := c.Get(url)
-	if err != nil {
-		fmt.Println("c.Do err", err)
-		return nil, err
-	}
-	if resp == nil {
-		resp.Body.Close()
-		return nil, errors.New("fatal, resp is nil")
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("http error: status code %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-	// 用ioutil.ReadAll可能户内存溢出，自己重写ReadAll方法，把之前的512改为256
-	bytes, err := ReadAll(resp.Body)
-	// var buf bytes.Buffer
-	// fmt.Println("start io copy")
-	// _, err = io.Copy(&buf, resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	return bytes, nil
+// GetBytesByProxyContext is GetBytesByProxy cancelled with ctx
+func GetBytesByProxyContext(ctx context.Context, url string, headers map[string]string, uri *url.URL) ([]byte, error) {
+	return ProxyClient(uri).GetBytesContext(ctx, url, headers)
+}
+
+// GetRangeByProxy is Client.GetRange with the shared client of proxy uri
+func GetRangeByProxy(url string, headers map[string]string, uri *url.URL, offset uint64, length uint64) ([]byte, error) {
+	return ProxyClient(uri).GetRange(url, headers, offset, length)
 }
 
 func ReadAll(r io.Reader) ([]byte, error) {
@@ -0,0 +1,153 @@
+package tool
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits throttles the requests of a Client, zero values mean no limit
+type Limits struct {
+	Bandwidth             int64   // bytes per second read from response bodies
+	HostRequestsPerSecond float64 // requests per second sent to each host
+}
+
+// RateLimiter is a token bucket refilled with rate tokens per second up to burst tokens
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst float64) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait takes n tokens, blocking until the bucket has refilled enough if it runs short.
+// The tokens are reserved at once, so concurrent callers are served in order. A nil RateLimiter never blocks.
+func (l *RateLimiter) Wait(n int) {
+	_ = l.WaitContext(context.Background(), n)
+}
+
+// WaitContext is Wait returning ctx.Err() as soon as ctx is done, the tokens of a cancelled wait are returned
+func (l *RateLimiter) WaitContext(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// Give the reservation back, the next callers are not held up by a request that was never sent
+		l.mu.Lock()
+		l.tokens += float64(n)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// hostLimiter spaces the requests to every host
+type hostLimiter struct {
+	mu    sync.Mutex
+	rate  float64
+	hosts map[string]*RateLimiter
+}
+
+func newHostLimiter(rate float64) *hostLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &hostLimiter{rate: rate, hosts: make(map[string]*RateLimiter)}
+}
+
+func (h *hostLimiter) wait(ctx context.Context, host string) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	l, ok := h.hosts[host]
+	if !ok {
+		l = NewRateLimiter(h.rate, 1)
+		h.hosts[host] = l
+	}
+	h.mu.Unlock()
+	return l.WaitContext(ctx, 1)
+}
+
+func newBandwidthLimiter(bandwidth int64) *RateLimiter {
+	if bandwidth <= 0 {
+		return nil
+	}
+	// One second worth of bytes, but at least a read buffer
+	burst := float64(bandwidth)
+	if burst < throttledReadSize {
+		burst = throttledReadSize
+	}
+	return NewRateLimiter(float64(bandwidth), burst)
+}
+
+var (
+	globalMu        sync.RWMutex
+	globalBandwidth *RateLimiter
+	globalHosts     *hostLimiter
+)
+
+// SetGlobalLimits throttles all Clients of the process together, on top of the limits of each Client
+func SetGlobalLimits(limits Limits) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	globalBandwidth = newBandwidthLimiter(limits.Bandwidth)
+	globalHosts = newHostLimiter(limits.HostRequestsPerSecond)
+}
+
+func globalLimiters() (*RateLimiter, *hostLimiter) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return globalBandwidth, globalHosts
+}
+
+// throttledReadSize bounds every read of a throttled body, so that the bandwidth is spread evenly
+const throttledReadSize = 32 << 10
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttledReadSize {
+		p = p[:throttledReadSize]
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, l := range b.limiters {
+		if werr := l.WaitContext(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,59 @@
+package tool
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimits(t *testing.T) {
+	content := bytes.Repeat([]byte{0x47}, 96<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	// The burst covers the first 32KiB, the other 64KiB take 2 seconds at 32KiB/s
+	c := NewClient(ClientOptions{Limits: Limits{Bandwidth: 32 << 10}})
+	start := time.Now()
+	b, err := c.GetBytes(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("wrong body")
+	}
+	if elapsed := time.Since(start); elapsed < 1900*time.Millisecond {
+		t.Fatalf("bandwidth was not limited, body read in %s", elapsed)
+	}
+
+	c = c.WithLimits(Limits{HostRequestsPerSecond: 10})
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := c.GetBytes(server.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 290*time.Millisecond {
+		t.Fatalf("requests were not spaced, 4 requests sent in %s", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(10, 1)
+	l.Wait(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.WaitContext(ctx, 10); err == nil {
+		t.Fatal("expected the error of the cancelled context")
+	}
+	// Only the token taken by the first wait is missing, not the 10 of the cancelled one
+	start := time.Now()
+	l.Wait(1)
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("wait after a cancelled wait took %s", elapsed)
+	}
+}
@@ -0,0 +1,579 @@
+package tool
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SAMPLE-AES for MPEG-2 transport streams, see Apple's "MPEG-2 Stream Encryption Format for HTTP Live Streaming".
+// Only the H.264 slices, ADTS AAC frames and (E-)AC-3 sync frames are encrypted, the TS and PES
+// layers are in the clear. Decryption works per PES packet and re-packetizes the PES afterwards,
+// since removing and re-inserting H.264 emulation prevention bytes may change its length.
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// Stream types of the PMT, the SAMPLE-AES ones are rewritten to their clear equivalent
+var sampleAESStreamTypes = map[byte]byte{
+	0xdb: 0x1b, // H.264
+	0xcf: 0x0f, // AAC ADTS
+	0xc1: 0x81, // AC-3
+	0xc2: 0x87, // E-AC-3
+}
+
+type sampleAESCodec int
+
+const (
+	codecNone sampleAESCodec = iota
+	codecH264
+	codecAAC
+	codecAC3
+)
+
+func codecOfStreamType(streamType byte) sampleAESCodec {
+	if clear, ok := sampleAESStreamTypes[streamType]; ok {
+		streamType = clear
+	}
+	switch streamType {
+	case 0x1b:
+		return codecH264
+	case 0x0f:
+		return codecAAC
+	case 0x81, 0x87:
+		return codecAC3
+	}
+	return codecNone
+}
+
+type tsPacket struct {
+	pid     uint16
+	pusi    bool
+	cc      byte
+	af      []byte // adaptation field without the length byte and stuffing, nil if absent
+	payload []byte
+}
+
+type pesPacket struct {
+	pid     uint16
+	packets []int // indexes of the TS packets carrying the PES
+	rebuilt [][]byte
+}
+
+// SampleAESDecryptTS decrypts a SAMPLE-AES encrypted transport stream segment with the 16 bytes key and iv
+func SampleAESDecryptTS(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid IV length %d, expected %d", len(iv), block.BlockSize())
+	}
+	start := 0
+	for start < len(data) && data[start] != tsSyncByte {
+		start++
+	}
+	count := (len(data) - start) / tsPacketSize
+	if count == 0 {
+		return nil, errors.New("no transport stream packets")
+	}
+	var (
+		packets = make([]*tsPacket, count)
+		pmtPIDs = make(map[uint16]bool)
+		codecs  = make(map[uint16]sampleAESCodec)
+		pending = make(map[uint16]*pesPacket)
+		owner   = make([]*pesPacket, count)
+		pesList []*pesPacket
+	)
+	for i := 0; i < count; i++ {
+		raw := data[start+i*tsPacketSize : start+(i+1)*tsPacketSize]
+		pkt, err := parseTSPacket(raw)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %s", i, err.Error())
+		}
+		packets[i] = pkt
+		switch {
+		case pkt.pid == 0 && pkt.pusi:
+			for _, pid := range parsePAT(pkt.payload) {
+				pmtPIDs[pid] = true
+			}
+		case pmtPIDs[pkt.pid] && pkt.pusi:
+			for pid, streamType := range parsePMT(pkt.payload) {
+				codecs[pid] = codecOfStreamType(streamType)
+			}
+			// Announce the clear stream types, players would refuse the SAMPLE-AES ones
+			pkt.payload = clearPMT(pkt.payload)
+		case codecs[pkt.pid] != codecNone:
+			if pkt.pusi {
+				pes := &pesPacket{pid: pkt.pid}
+				pending[pkt.pid] = pes
+				pesList = append(pesList, pes)
+			}
+			if pes := pending[pkt.pid]; pes != nil {
+				pes.packets = append(pes.packets, i)
+				owner[i] = pes
+			}
+		}
+	}
+
+	for _, pes := range pesList {
+		var payload []byte
+		for _, idx := range pes.packets {
+			payload = append(payload, packets[idx].payload...)
+		}
+		decrypted, err := decryptPES(payload, codecs[pes.pid], block, iv)
+		if err != nil {
+			return nil, fmt.Errorf("PID %d: %s", pes.pid, err.Error())
+		}
+		pes.rebuilt = packetizePES(decrypted, pes, packets)
+	}
+
+	out := make([]byte, 0, len(data)-start+tsPacketSize)
+	ccs := make(map[uint16]byte)
+	emitted := make(map[*pesPacket]int)
+	for i, pkt := range packets {
+		pes := owner[i]
+		if pes == nil {
+			raw := data[start+i*tsPacketSize : start+(i+1)*tsPacketSize]
+			if pmtPIDs[pkt.pid] && pkt.pusi {
+				raw = buildTSPacket(pkt.pid, true, pkt.cc, pkt.af, pkt.payload)
+			}
+			out = append(out, raw...)
+			continue
+		}
+		// Rebuilt packets take the places of the original ones, surplus packets follow the last one
+		n := emitted[pes]
+		last := pes.packets[len(pes.packets)-1] == i
+		for n < len(pes.rebuilt) {
+			cc, ok := ccs[pes.pid]
+			if !ok {
+				cc = packets[pes.packets[0]].cc
+			}
+			pkt := pes.rebuilt[n]
+			pkt[3] = pkt[3]&0xf0 | cc&0x0f
+			ccs[pes.pid] = cc + 1
+			out = append(out, pkt...)
+			n++
+			if !last {
+				break
+			}
+		}
+		emitted[pes] = n
+	}
+	return out, nil
+}
+
+func parseTSPacket(raw []byte) (*tsPacket, error) {
+	if raw[0] != tsSyncByte {
+		return nil, errors.New("lost sync byte")
+	}
+	pkt := &tsPacket{
+		pid:  binary.BigEndian.Uint16(raw[1:3]) & 0x1fff,
+		pusi: raw[1]&0x40 != 0,
+		cc:   raw[3] & 0x0f,
+	}
+	control := raw[3] >> 4 & 0x03
+	pos := 4
+	if control&0x02 != 0 {
+		length := int(raw[4])
+		if 5+length > tsPacketSize {
+			return nil, errors.New("invalid adaptation field length")
+		}
+		if length > 0 {
+			pkt.af = raw[5 : 5+adaptationFieldLength(raw[5:5+length])]
+		} else {
+			pkt.af = []byte{}
+		}
+		pos = 5 + length
+	}
+	if control&0x01 != 0 {
+		pkt.payload = raw[pos:]
+	}
+	return pkt, nil
+}
+
+// adaptationFieldLength returns the length of the adaptation field without its stuffing bytes
+func adaptationFieldLength(af []byte) int {
+	flags := af[0]
+	n := 1
+	if flags&0x10 != 0 { // PCR
+		n += 6
+	}
+	if flags&0x08 != 0 { // OPCR
+		n += 6
+	}
+	if flags&0x04 != 0 { // splice countdown
+		n++
+	}
+	if flags&0x02 != 0 && n < len(af) { // transport private data
+		n += 1 + int(af[n])
+	}
+	if flags&0x01 != 0 && n < len(af) { // adaptation field extension
+		n += 1 + int(af[n])
+	}
+	if n > len(af) {
+		return len(af)
+	}
+	return n
+}
+
+// buildTSPacket builds a packet carrying as much of payload as fits, stuffing the rest
+func buildTSPacket(pid uint16, pusi bool, cc byte, af []byte, payload []byte) []byte {
+	pkt := make([]byte, tsPacketSize)
+	pkt[0] = tsSyncByte
+	binary.BigEndian.PutUint16(pkt[1:3], pid&0x1fff)
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	capacity := tsPacketSize - 4
+	if af != nil {
+		capacity -= 1 + len(af)
+	}
+	if len(payload) >= capacity {
+		payload = payload[:capacity]
+	} else if af == nil {
+		// An adaptation field is needed for stuffing
+		af = []byte{}
+		capacity--
+		if capacity > len(payload) {
+			af = []byte{0x00}
+			capacity--
+		}
+	}
+	pos := 4
+	control := byte(0x01)
+	if af != nil {
+		control |= 0x02
+		stuffing := capacity - len(payload)
+		pkt[4] = byte(len(af) + stuffing)
+		copy(pkt[5:], af)
+		for i := 0; i < stuffing; i++ {
+			pkt[5+len(af)+i] = 0xff
+		}
+		pos = 5 + len(af) + stuffing
+	}
+	pkt[3] = control<<4 | cc&0x0f
+	copy(pkt[pos:], payload)
+	return pkt
+}
+
+// packetizePES splits a PES into TS packets, reusing the adaptation fields of the original packets
+func packetizePES(payload []byte, pes *pesPacket, packets []*tsPacket) [][]byte {
+	var rebuilt [][]byte
+	for i := 0; len(payload) > 0 || i == 0; i++ {
+		var af []byte
+		if i < len(pes.packets) {
+			af = packets[pes.packets[i]].af
+		}
+		pkt := buildTSPacket(pes.pid, i == 0, 0, af, payload)
+		n := tsPacketSize - payloadOffset(pkt)
+		if n > len(payload) {
+			n = len(payload)
+		}
+		payload = payload[n:]
+		rebuilt = append(rebuilt, pkt)
+	}
+	return rebuilt
+}
+
+func payloadOffset(pkt []byte) int {
+	if pkt[3]&0x20 != 0 {
+		return 5 + int(pkt[4])
+	}
+	return 4
+}
+
+func parsePAT(payload []byte) []uint16 {
+	section := psiSection(payload)
+	if len(section) < 12 {
+		return nil
+	}
+	var pids []uint16
+	// Program loop between the 8 bytes header and the CRC
+	for pos := 8; pos+4 <= len(section)-4; pos += 4 {
+		program := binary.BigEndian.Uint16(section[pos:])
+		if program != 0 {
+			pids = append(pids, binary.BigEndian.Uint16(section[pos+2:])&0x1fff)
+		}
+	}
+	return pids
+}
+
+func parsePMT(payload []byte) map[uint16]byte {
+	section := psiSection(payload)
+	streams := make(map[uint16]byte)
+	if len(section) < 16 {
+		return streams
+	}
+	infoLength := int(binary.BigEndian.Uint16(section[10:]) & 0x0fff)
+	for pos := 12 + infoLength; pos+5 <= len(section)-4; {
+		streamType := section[pos]
+		pid := binary.BigEndian.Uint16(section[pos+1:]) & 0x1fff
+		esInfoLength := int(binary.BigEndian.Uint16(section[pos+3:]) & 0x0fff)
+		streams[pid] = streamType
+		pos += 5 + esInfoLength
+	}
+	return streams
+}
+
+// clearPMT returns a copy of the PMT payload with the SAMPLE-AES stream types replaced
+func clearPMT(payload []byte) []byte {
+	if len(payload) == 0 {
+		return payload
+	}
+	payload = append([]byte(nil), payload...)
+	section := psiSection(payload)
+	if len(section) < 16 {
+		return payload
+	}
+	infoLength := int(binary.BigEndian.Uint16(section[10:]) & 0x0fff)
+	changed := false
+	for pos := 12 + infoLength; pos+5 <= len(section)-4; {
+		if clear, ok := sampleAESStreamTypes[section[pos]]; ok {
+			section[pos] = clear
+			changed = true
+		}
+		pos += 5 + int(binary.BigEndian.Uint16(section[pos+3:])&0x0fff)
+	}
+	if changed {
+		binary.BigEndian.PutUint32(section[len(section)-4:], crc32MPEG2(section[:len(section)-4]))
+	}
+	return payload
+}
+
+// psiSection returns the section following the pointer field, CRC included
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	pos := 1 + int(payload[0])
+	if pos+3 > len(payload) {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(payload[pos+1:]) & 0x0fff)
+	end := pos + 3 + length
+	if end > len(payload) {
+		return nil
+	}
+	return payload[pos:end]
+}
+
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// decryptPES decrypts the elementary stream data of a PES packet
+func decryptPES(pes []byte, codec sampleAESCodec, block cipher.Block, iv []byte) ([]byte, error) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil, errors.New("invalid PES start code")
+	}
+	headerLength := 9 + int(pes[8])
+	if headerLength > len(pes) {
+		return nil, errors.New("invalid PES header length")
+	}
+	es := pes[headerLength:]
+	switch codec {
+	case codecH264:
+		es = decryptH264(es, block, iv)
+	case codecAAC:
+		decryptAAC(es, block, iv)
+	case codecAC3:
+		decryptAC3(es, block, iv)
+	}
+	out := append(append([]byte(nil), pes[:headerLength]...), es...)
+	if binary.BigEndian.Uint16(pes[4:6]) != 0 {
+		length := len(out) - 6
+		if length > 0xffff {
+			length = 0
+		}
+		binary.BigEndian.PutUint16(out[4:6], uint16(length))
+	}
+	return out, nil
+}
+
+// decryptH264 decrypts the slice NAL units of an Annex B byte stream,
+// the stream is returned with emulation prevention bytes re-inserted.
+func decryptH264(es []byte, block cipher.Block, iv []byte) []byte {
+	nals := splitNALUnits(es)
+	if len(nals) == 0 {
+		return es
+	}
+	var out []byte
+	for _, nal := range nals {
+		out = append(out, 0, 0, 0, 1)
+		nalType := nal[0] & 0x1f
+		if (nalType != 1 && nalType != 5) || len(nal) <= 48 {
+			out = append(out, nal...)
+			continue
+		}
+		raw := removeEmulationPrevention(nal)
+		// 32 bytes clear leader, then one encrypted block out of every ten
+		mode := cipher.NewCBCDecrypter(block, iv)
+		for pos := 32; pos < len(raw); pos += 144 {
+			if len(raw)-pos > 16 {
+				mode.CryptBlocks(raw[pos:pos+16], raw[pos:pos+16])
+				pos += 16
+			}
+		}
+		out = append(out, addEmulationPrevention(raw)...)
+	}
+	return out
+}
+
+// decryptAAC decrypts ADTS frames in place
+func decryptAAC(es []byte, block cipher.Block, iv []byte) {
+	for pos := 0; pos+7 <= len(es); {
+		if es[pos] != 0xff || es[pos+1]&0xf0 != 0xf0 {
+			pos++
+			continue
+		}
+		headerLength := 7
+		if es[pos+1]&0x01 == 0 {
+			// CRC present
+			headerLength = 9
+		}
+		frameLength := int(es[pos+3]&0x03)<<11 | int(es[pos+4])<<3 | int(es[pos+5])>>5
+		if frameLength < headerLength || pos+frameLength > len(es) {
+			return
+		}
+		decryptFrame(es[pos+headerLength:pos+frameLength], block, iv)
+		pos += frameLength
+	}
+}
+
+// decryptAC3 decrypts AC-3 and E-AC-3 sync frames in place
+func decryptAC3(es []byte, block cipher.Block, iv []byte) {
+	for pos := 0; pos+6 <= len(es); {
+		if es[pos] != 0x0b || es[pos+1] != 0x77 {
+			pos++
+			continue
+		}
+		frameLength := ac3FrameLength(es[pos:])
+		if frameLength == 0 || pos+frameLength > len(es) {
+			return
+		}
+		decryptFrame(es[pos:pos+frameLength], block, iv)
+		pos += frameLength
+	}
+}
+
+// decryptFrame decrypts an audio frame: 16 bytes clear leader, encrypted blocks, clear trailer
+func decryptFrame(frame []byte, block cipher.Block, iv []byte) {
+	if len(frame) <= 16 {
+		return
+	}
+	data := frame[16:]
+	n := len(data) / 16 * 16
+	if n > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data[:n], data[:n])
+	}
+}
+
+// AC-3 frame sizes in 16-bit words by frmsizecod and 48, 44.1 and 32 kHz sample rates
+var ac3FrameSizes = [38][3]int{
+	{64, 69, 96}, {64, 70, 96}, {80, 87, 120}, {80, 88, 120}, {96, 104, 144}, {96, 105, 144},
+	{112, 121, 168}, {112, 122, 168}, {128, 139, 192}, {128, 140, 192}, {160, 174, 240}, {160, 175, 240},
+	{192, 208, 288}, {192, 209, 288}, {224, 243, 336}, {224, 244, 336}, {256, 278, 384}, {256, 279, 384},
+	{320, 348, 480}, {320, 349, 480}, {384, 417, 576}, {384, 418, 576}, {448, 487, 672}, {448, 488, 672},
+	{512, 557, 768}, {512, 558, 768}, {640, 696, 960}, {640, 697, 960}, {768, 835, 1152}, {768, 836, 1152},
+	{896, 975, 1344}, {896, 976, 1344}, {1024, 1114, 1536}, {1024, 1115, 1536}, {1152, 1253, 1728},
+	{1152, 1254, 1728}, {1280, 1393, 1920}, {1280, 1394, 1920},
+}
+
+func ac3FrameLength(frame []byte) int {
+	bsid := frame[5] >> 3
+	if bsid > 10 {
+		// E-AC-3, frmsiz is the frame size in words minus one
+		return (int(frame[2]&0x07)<<8 | int(frame[3]) + 1) * 2
+	}
+	fscod := frame[4] >> 6
+	frmsizecod := frame[4] & 0x3f
+	if fscod > 2 || int(frmsizecod) >= len(ac3FrameSizes) {
+		return 0
+	}
+	return ac3FrameSizes[frmsizecod][fscod] * 2
+}
+
+// splitNALUnits splits an Annex B byte stream at its start codes
+func splitNALUnits(es []byte) [][]byte {
+	var (
+		nals  [][]byte
+		start = -1
+	)
+	for i := 0; i+2 < len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// A zero byte before the start code belongs to a 4 bytes start code
+			for end > start && es[end-1] == 0 {
+				end--
+			}
+			nals = append(nals, es[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(es) {
+		nals = append(nals, es[start:])
+	}
+	var result [][]byte
+	for _, nal := range nals {
+		if len(nal) > 0 {
+			result = append(result, nal)
+		}
+	}
+	return result
+}
+
+func removeEmulationPrevention(nal []byte) []byte {
+	raw := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		raw = append(raw, b)
+	}
+	return raw
+}
+
+func addEmulationPrevention(raw []byte) []byte {
+	nal := make([]byte, 0, len(raw)+len(raw)/64)
+	zeros := 0
+	for _, b := range raw {
+		if zeros >= 2 && b <= 0x03 {
+			nal = append(nal, 0x03)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, b)
+	}
+	return nal
+}
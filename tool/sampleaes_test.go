@@ -0,0 +1,126 @@
+package tool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"testing"
+)
+
+func psiPayload(section []byte) []byte {
+	section = append(section, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(section[len(section)-4:], crc32MPEG2(section[:len(section)-4]))
+	return append([]byte{0}, section...)
+}
+
+func TestSampleAESDecryptTS(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+
+	// One ADTS frame: 7 bytes header, 16 bytes clear leader, 6 encrypted blocks, 5 bytes clear trailer
+	frame := make([]byte, 7+16+96+5)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	frame[0], frame[1] = 0xff, 0xf1
+	frame[3] = byte(len(frame) >> 11 & 0x03)
+	frame[4] = byte(len(frame) >> 3)
+	frame[5] = byte(len(frame)<<5) | 0x1f
+	encrypted := append([]byte(nil), frame...)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted[23:119], encrypted[23:119])
+
+	pes := []byte{0, 0, 1, 0xc0, 0, 0, 0x80, 0, 0}
+	binary.BigEndian.PutUint16(pes[4:], uint16(len(pes)-6+len(encrypted)))
+	pat := psiPayload([]byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	pmt := psiPayload([]byte{0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0, 0xcf, 0xe1, 0x01, 0xf0, 0})
+	var ts []byte
+	ts = append(ts, buildTSPacket(0, true, 0, nil, pat)...)
+	ts = append(ts, buildTSPacket(0x1000, true, 0, nil, pmt)...)
+	ts = append(ts, buildTSPacket(0x101, true, 3, nil, append(pes, encrypted...))...)
+
+	out, err := SampleAESDecryptTS(ts, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(ts) {
+		t.Fatalf("wrong length, expected: %d, result: %d", len(ts), len(out))
+	}
+	pmtPacket, err := parseTSPacket(out[tsPacketSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams := parsePMT(pmtPacket.payload); streams[0x101] != 0x0f {
+		t.Fatalf("wrong stream type, expected: 0x0f, result: %#x", streams[0x101])
+	}
+	audio, err := parseTSPacket(out[2*tsPacketSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.cc != 3 {
+		t.Fatalf("wrong continuity counter, expected: 3, result: %d", audio.cc)
+	}
+	if !bytes.Equal(audio.payload[len(pes):], frame) {
+		t.Fatalf("wrong frame, expected: %x, result: %x", frame, audio.payload[len(pes):])
+	}
+}
+
+func TestSampleAESDecryptTSH264(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+
+	// An IDR slice with zero runs, the encrypted stream needs emulation prevention bytes
+	raw := make([]byte, 400)
+	for i := range raw {
+		if i%5 != 0 {
+			raw[i] = byte(i)
+		}
+	}
+	raw[0], raw[len(raw)-1] = 0x65, 0x80
+	// 32 bytes clear leader, then one encrypted block out of every ten
+	encrypted := append([]byte(nil), raw...)
+	block, _ := aes.NewCipher(key)
+	mode := cipher.NewCBCEncrypter(block, iv)
+	for pos := 32; len(encrypted)-pos > 16; pos += 160 {
+		mode.CryptBlocks(encrypted[pos:pos+16], encrypted[pos:pos+16])
+	}
+	sps := []byte{0x67, 0x64, 0x00, 0x1f}
+
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0, 0}
+	pes = append(append(append(pes, 0, 0, 0, 1), sps...), 0, 0, 0, 1)
+	pes = append(pes, addEmulationPrevention(encrypted)...)
+	pat := psiPayload([]byte{0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+	pmt := psiPayload([]byte{0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x01, 0xf0, 0, 0xdb, 0xe1, 0x01, 0xf0, 0})
+	var ts []byte
+	ts = append(ts, buildTSPacket(0, true, 0, nil, pat)...)
+	ts = append(ts, buildTSPacket(0x1000, true, 0, nil, pmt)...)
+	for i, pkt := range packetizePES(pes, &pesPacket{pid: 0x101}, nil) {
+		pkt[3] = pkt[3]&0xf0 | byte(i)&0x0f
+		ts = append(ts, pkt...)
+	}
+
+	out, err := SampleAESDecryptTS(ts, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmtPacket, err := parseTSPacket(out[tsPacketSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams := parsePMT(pmtPacket.payload); streams[0x101] != 0x1b {
+		t.Fatalf("wrong stream type, expected: 0x1b, result: %#x", streams[0x101])
+	}
+	var video []byte
+	for pos := 2 * tsPacketSize; pos < len(out); pos += tsPacketSize {
+		pkt, err := parseTSPacket(out[pos : pos+tsPacketSize])
+		if err != nil {
+			t.Fatal(err)
+		}
+		video = append(video, pkt.payload...)
+	}
+	es := append(append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 0, 1), addEmulationPrevention(raw)...)
+	if len(video) < 9 || !bytes.Equal(video[9:], es) {
+		t.Fatalf("wrong stream, expected: %x, result: %x", es, video)
+	}
+}
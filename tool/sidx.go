@@ -0,0 +1,77 @@
+package tool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SegmentIndex is a segment index box ('sidx', ISO/IEC 14496-12 section 8.16.3),
+// it lists the byte ranges and durations of the subsegments of a single-file fragmented MP4
+type SegmentIndex struct {
+	Timescale   uint32
+	EarliestPTS uint64
+	// FirstOffset is the distance from the first byte after the box to the first subsegment
+	FirstOffset uint64
+	References  []SegmentIndexReference
+}
+
+type SegmentIndexReference struct {
+	Size     uint32 // bytes, subsegments follow each other
+	Duration uint32 // in Timescale units
+}
+
+// ParseSegmentIndex reads the first 'sidx' box of data, usually the indexRange of a DASH SegmentBase,
+// and returns it with the length of data up to the end of the box.
+func ParseSegmentIndex(data []byte) (*SegmentIndex, int, error) {
+	boxes, err := mp4Boxes(data, 0, len(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	box := findBox(boxes, "sidx")
+	if box == nil {
+		return nil, 0, errors.New("no sidx box")
+	}
+	body := data[box.offset:box.end]
+	if len(body) < 12 {
+		return nil, 0, errors.New("truncated sidx box")
+	}
+	version := body[0]
+	sidx := &SegmentIndex{Timescale: binary.BigEndian.Uint32(body[8:])}
+	pos := 12
+	if version == 0 {
+		if len(body) < pos+8 {
+			return nil, 0, errors.New("truncated sidx box")
+		}
+		sidx.EarliestPTS = uint64(binary.BigEndian.Uint32(body[pos:]))
+		sidx.FirstOffset = uint64(binary.BigEndian.Uint32(body[pos+4:]))
+		pos += 8
+	} else {
+		if len(body) < pos+16 {
+			return nil, 0, errors.New("truncated sidx box")
+		}
+		sidx.EarliestPTS = binary.BigEndian.Uint64(body[pos:])
+		sidx.FirstOffset = binary.BigEndian.Uint64(body[pos+8:])
+		pos += 16
+	}
+	if len(body) < pos+4 {
+		return nil, 0, errors.New("truncated sidx box")
+	}
+	count := int(binary.BigEndian.Uint16(body[pos+2:]))
+	pos += 4
+	if len(body) < pos+count*12 {
+		return nil, 0, fmt.Errorf("sidx box too short for %d references", count)
+	}
+	for i := 0; i < count; i++ {
+		ref := binary.BigEndian.Uint32(body[pos:])
+		if ref>>31 == 1 {
+			return nil, 0, errors.New("hierarchical sidx is not supported")
+		}
+		sidx.References = append(sidx.References, SegmentIndexReference{
+			Size:     ref & 0x7fffffff,
+			Duration: binary.BigEndian.Uint32(body[pos+4:]),
+		})
+		pos += 12
+	}
+	return sidx, box.end, nil
+}
@@ -0,0 +1,139 @@
+package tool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamBufferSize is the size of the buffers of the streaming readers, a multiple of the AES block size
+const streamBufferSize = 32 << 10
+
+// cbcDecryptReader decrypts an AES-128 CBC stream. The last plaintext block is held back
+// until the end of the stream, since the PKCS#7 padding it ends with has to be removed.
+type cbcDecryptReader struct {
+	r       io.Reader
+	mode    cipher.BlockMode
+	buf     []byte // ciphertext, the first pending bytes are not decrypted yet
+	pending int
+	outBuf  []byte
+	out     []byte // plaintext not returned yet
+	held    []byte // last plaintext block
+	err     error
+}
+
+// NewAES128DecryptReader returns a reader decrypting r like AES128Decrypt, holding a few
+// buffers instead of the whole segment. iv must be the 16 bytes IV of the segment.
+func NewAES128DecryptReader(r io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid IV length %d, expected %d", len(iv), block.BlockSize())
+	}
+	return &cbcDecryptReader{
+		r:      r,
+		mode:   cipher.NewCBCDecrypter(block, iv),
+		buf:    make([]byte, streamBufferSize),
+		outBuf: make([]byte, streamBufferSize+aes.BlockSize),
+	}, nil
+}
+
+func (c *cbcDecryptReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.fill()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// fill reads more ciphertext and decrypts its full blocks into out
+func (c *cbcDecryptReader) fill() {
+	n, err := c.r.Read(c.buf[c.pending:])
+	c.pending += n
+	switch {
+	case err == io.EOF:
+		if c.pending%aes.BlockSize != 0 {
+			c.err = errors.New("input not full blocks")
+			return
+		}
+		c.mode.CryptBlocks(c.buf[:c.pending], c.buf[:c.pending])
+		out := append(append(c.outBuf[:0], c.held...), c.buf[:c.pending]...)
+		c.pending, c.held = 0, nil
+		if len(out) > 0 {
+			padding := int(out[len(out)-1])
+			if padding == 0 || padding > aes.BlockSize || padding > len(out) {
+				c.err = errors.New("invalid padding")
+				return
+			}
+			out = out[:len(out)-padding]
+		}
+		c.out, c.err = out, io.EOF
+	case err != nil:
+		c.err = err
+	default:
+		full := c.pending / aes.BlockSize * aes.BlockSize
+		if full == 0 {
+			return
+		}
+		c.mode.CryptBlocks(c.buf[:full], c.buf[:full])
+		c.out = append(append(c.outBuf[:0], c.held...), c.buf[:full-aes.BlockSize]...)
+		c.held = append(c.held[:0], c.buf[full-aes.BlockSize:full]...)
+		c.pending = copy(c.buf, c.buf[full:c.pending])
+	}
+}
+
+// maxSyncSearch bounds the bytes searched for the first TS sync byte
+const maxSyncSearch = 1 << 20
+
+// syncByteReader drops the bytes before the first TS sync byte 0x47. A stream without sync byte
+// in its first maxSyncSearch bytes is passed on unchanged.
+type syncByteReader struct {
+	r       io.Reader
+	buf     []byte
+	skipped []byte // bytes before the sync byte, returned if there is none
+	out     []byte
+	synced  bool
+	err     error
+}
+
+// NewSyncByteReader returns a reader aligning a TS stream on its first sync byte,
+// see https://en.wikipedia.org/wiki/MPEG_transport_stream
+func NewSyncByteReader(r io.Reader) io.Reader {
+	return &syncByteReader{r: r}
+}
+
+func (s *syncByteReader) Read(p []byte) (int, error) {
+	for !s.synced {
+		if s.buf == nil {
+			s.buf = make([]byte, streamBufferSize)
+		}
+		n, err := s.r.Read(s.buf)
+		if i := bytes.IndexByte(s.buf[:n], 0x47); i >= 0 {
+			s.out, s.synced = s.buf[i:n], true
+		} else {
+			s.skipped = append(s.skipped, s.buf[:n]...)
+			if err != nil || len(s.skipped) > maxSyncSearch {
+				s.out, s.synced = s.skipped, true
+			}
+		}
+		s.err = err
+	}
+	if len(s.out) > 0 {
+		n := copy(p, s.out)
+		s.out = s.out[n:]
+		return n, nil
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.r.Read(p)
+}
@@ -0,0 +1,52 @@
+package tool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAES128DecryptReader(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := []byte("fedcba9876543210")
+	for _, size := range []int{0, 1, 15, 16, 17, streamBufferSize - 1, streamBufferSize, 3*streamBufferSize + 5} {
+		plain := bytes.Repeat([]byte{0x47, 1, 2, 3, 4, 5, 6}, size/7+1)[:size]
+		crypted, err := AES128Encrypt(append([]byte(nil), plain...), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr, err := NewAES128DecryptReader(iotest.HalfReader(bytes.NewReader(crypted)), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(b, plain) {
+			t.Fatalf("size %d: wrong plaintext of %d bytes", size, len(b))
+		}
+	}
+	dr, _ := NewAES128DecryptReader(bytes.NewReader(make([]byte, 20)), key, iv)
+	if _, err := ioutil.ReadAll(dr); err == nil {
+		t.Fatal("partial block was accepted")
+	}
+}
+
+func TestSyncByteReader(t *testing.T) {
+	for input, expected := range map[string]string{
+		"junk\x47\x00\x47": "\x47\x00\x47",
+		"\x47abc":          "\x47abc",
+		"no sync byte":     "no sync byte",
+		"":                 "",
+	} {
+		b, err := ioutil.ReadAll(NewSyncByteReader(iotest.OneByteReader(bytes.NewReader([]byte(input)))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("wrong alignment of %q: %q", input, b)
+		}
+	}
+}